@@ -69,11 +69,12 @@ function do_cmd(args)
     os.execute("echo Hello " .. args[1] .. " | sed s/foo/bar/")
 end
 
--- Your do_ function can take a third parameter. If it does, this
--- parameter will be the name of a temporary file created right before
--- your function is called that you can use to download your file to. The
--- file will exist and be blank at the start of the function, and will be
--- deleted right after.
+-- Commands listed in wants_tempfile get a second parameter, which will be
+-- the name of a temporary file created right before your function is called
+-- that you can use to download your file to. The file will exist and be
+-- blank at the start of the function, and will be deleted right after.
+wants_tempfile = {edit = true, cat = true}
+
 function do_edit(args, tempfile)
     -- The following is how you do an edit workflow, where a command downloads
     -- a file, you edit it in your text editor and then it's re-uploaded if it
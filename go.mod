@@ -0,0 +1,16 @@
+module github.com/mivok/simplecli
+
+go 1.26.0
+
+require (
+	github.com/chzyer/readline v1.5.1
+	github.com/google/shlex v0.0.0-20191202100458-e7afc7fbc510
+	github.com/valyala/fasttemplate v1.2.2
+	github.com/yuin/gopher-lua v1.1.2
+	golang.org/x/term v0.46.0
+)
+
+require (
+	github.com/valyala/bytebufferpool v1.0.0 // indirect
+	golang.org/x/sys v0.48.0 // indirect
+)
@@ -1,76 +1,591 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/big"
+	mathrand "math/rand"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
 	"github.com/chzyer/readline"
 	"github.com/google/shlex"
 	"github.com/valyala/fasttemplate"
 	"github.com/yuin/gopher-lua"
+	"golang.org/x/term"
 )
 
-func Run(luaFile string) {
+var evalFile = flag.String("eval-file", "",
+	"Run the main function in a lua file non-interactively, then exit")
+var genDocs = flag.String("gen-docs", "",
+	"Write command documentation (markdown or man) to the file given as the"+
+		" first argument, or stdout, then exit")
+var themeName = flag.String("theme", "default",
+	"Color theme to use (default, bright or none)")
+var profileStartup = flag.Bool("profile-startup", false,
+	"Print how long each part of startup took to stderr")
+var jsonOutput = flag.Bool("json", false,
+	"Print values returned by commands as JSON instead of formatting them")
+var allow = flag.String("allow", "",
+	"Only allow these commands (comma separated), plus the built in ones")
+var sandbox = flag.Bool("sandbox", false,
+	"Run the lua file without the os, io, debug and package libraries")
+var scriptFile = flag.String("script", "",
+	"Run the commands in a file, one per line, then exit")
+var stopOnError bool
+
+func init() {
+	flag.BoolVar(&stopOnError, "stop-on-error", false,
+		"Stop running a script at the first command that fails")
+	flag.BoolVar(&stopOnError, "e", false, "Short for -stop-on-error")
+}
+
+var argsOnly = flag.Bool("args", false,
+	"Don't run the arguments after the flags as a command, just make them"+
+		" available to lua in _args")
+var quietAll = flag.Bool("quiet-all", false,
+	"When running a script, only show the output of commands that fail")
+
+var recordFile = flag.String("record", "",
+	"Save each command and its output to a file, for --replay")
+var replayFile = flag.String("replay", "",
+	"Run the commands saved with --record, checking the output is the same,"+
+		" then exit")
+var controlSocket = flag.String("control-socket", "",
+	"Also read commands from connections to this unix socket, sending their"+
+		" output back")
+
+// luaLock is held whenever lua code is running. The main loop only lets go
+// of it while waiting for input, so that things like the terminal resize
+// handler can safely call into lua from another goroutine.
+var luaLock sync.Mutex
+
+// readline starts reading stdin as soon as it's created, which would take
+// piped input meant for a command run from the command line. It reads through
+// gatedStdin, which waits until the interactive loop starts.
+var stdinOpen = make(chan struct{})
+var openStdinOnce sync.Once
+
+type gatedStdin struct{}
+
+func (gatedStdin) Read(b []byte) (int, error) {
+	<-stdinOpen
+	return os.Stdin.Read(b)
+}
+
+func openStdin() {
+	openStdinOnce.Do(func() { close(stdinOpen) })
+}
+
+func stdinAvailable() bool {
+	// Stdin can be read by commands if it's piped in and readline isn't
+	// using it
+	select {
+	case <-stdinOpen:
+		return false
+	default:
+	}
+	return !stdinScript && !term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// stdinScript is set when commands are being read from stdin, so that
+// commands don't read them as their input too
+var stdinScript bool
+
+func shellJoin(args []string) string {
+	// Quotes arguments so that shlex splits them back up the same way
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && !strings.ContainsAny(arg, " \t\n'\"\\#;&|<>{}$") {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'"'"'`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+func sandboxRequested() bool {
+	// The lua state is made before flags are parsed (lua globals become
+	// flags), so --sandbox has to be looked for by hand. Any value the flag
+	// package would take for true counts, and parseCommandLineFlags checks
+	// afterwards that the two agree.
+	requested := false
+	for _, arg := range os.Args[1:] {
+		if arg == "--" {
+			break
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		if name == "sandbox" {
+			requested = true
+		} else if strings.HasPrefix(name, "sandbox=") {
+			value, err := strconv.ParseBool(name[len("sandbox="):])
+			requested = err == nil && value
+		}
+	}
+	return requested
+}
+
+func checkSandbox(L *lua.LState, name string) {
+	// The cli_ helpers that run programs or use files raise an error with
+	// --sandbox, as the libraries that could do the same aren't loaded
+	if sandboxRequested() {
+		L.RaiseError("%s can't be used with --sandbox", name)
+	}
+}
+
+func newLuaState() *lua.LState {
+	// With --sandbox, only the libraries that can't touch files or run
+	// programs are loaded. The cli_ helpers are still available.
+	if !sandboxRequested() {
+		return lua.NewState()
+	}
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+		{lua.CoroutineLibName, lua.OpenCoroutine},
+	} {
+		L.Push(L.NewFunction(lib.fn))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// The base library can still read lua files
+	for _, name := range []string{"dofile", "loadfile", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	return L
+}
+
+// startupTime is how long a step of startup took
+type startupTime struct {
+	step     string
+	duration time.Duration
+}
+
+func historyFile(L *lua.LState, luaFile string) string {
+	// Returns the file to keep command history in. This is history_file if
+	// it's set (an empty string turns history off), then
+	// $SIMPLECLI_HISTORY_FILE, then a file in your home directory named
+	// after the lua file, so each cli has its own history. With --sandbox,
+	// history_file can only turn history off, not move it somewhere else.
+	filename := os.Getenv("SIMPLECLI_HISTORY_FILE")
+	if v, ok := L.GetGlobal("history_file").(lua.LString); ok {
+		if v == "" {
+			return ""
+		}
+		if !sandboxRequested() {
+			filename = string(v)
+		}
+	}
+	if filename == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		name := strings.TrimSuffix(filepath.Base(luaFile), filepath.Ext(luaFile))
+		filename = filepath.Join(home, ".simplecli_history_"+name)
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		fmt.Println("Warning: can't create history directory:", err)
+		return ""
+	}
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		fmt.Println("Warning: history won't be saved:", err)
+		return ""
+	}
+	f.Close()
+	return filename
+}
+
+func stateFile(L *lua.LState) string {
+	// Returns the file the settings from the setup function are kept in.
+	// This is state_file if it's set, or a file in your home directory named
+	// after the lua file. With --sandbox, the file can't choose where its
+	// settings go, so a state_file means nothing is loaded or saved.
+	if v, ok := L.GetGlobal("state_file").(lua.LString); ok && v != "" {
+		if sandboxRequested() {
+			return ""
+		}
+		return string(v)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	name := strings.TrimSuffix(filepath.Base(cliFile), filepath.Ext(cliFile))
+	return filepath.Join(home, ".simplecli_state_"+name+".json")
+}
+
+// stateNames are the globals that were set from the state file
+var stateNames = map[string]bool{}
+
+func loadState(L *lua.LState) {
+	// Sets globals from the settings saved by the setup function, if they
+	// have been saved yet
+	filename := stateFile(L)
+	if filename == "" {
+		return
+	}
+	contents, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		fmt.Println("Warning: can't read state file:", err)
+		return
+	}
+	values := map[string]interface{}{}
+	if err := json.Unmarshal(contents, &values); err != nil {
+		fmt.Printf("Warning: can't read state file %s: %s\n", filename, err)
+		return
+	}
+	for name, value := range values {
+		L.SetGlobal(name, goToLua(L, value))
+		stateNames[name] = true
+	}
+}
+
+func needsSetup(L *lua.LState) bool {
+	// The setup function is run the first time the cli is used, which is
+	// when there isn't a state file yet
+	if _, ok := L.GetGlobal("setup").(*lua.LFunction); !ok {
+		return false
+	}
+	filename := stateFile(L)
+	if filename == "" {
+		return false
+	}
+	_, err := os.Stat(filename)
+	return os.IsNotExist(err)
+}
+
+func runSetup(L *lua.LState) commandStatus {
+	// Calls the setup function, which asks for whatever the cli needs, and
+	// saves the table of settings it returns to the state file. They're set
+	// as globals straight away, and again each time the cli starts.
+	fn, ok := L.GetGlobal("setup").(*lua.LFunction)
+	if !ok {
+		fmt.Println("There's no setup function")
+		return statusError
+	}
+	filename := stateFile(L)
+	if filename == "" {
+		if v, ok := L.GetGlobal("state_file").(lua.LString); ok && v != "" &&
+			sandboxRequested() {
+			fmt.Println("Settings can't be saved: state_file can't be " +
+				"used with --sandbox")
+		} else {
+			fmt.Println("Settings can't be saved: there's no home directory")
+		}
+		return statusError
+	}
+	result, err := callCommand(L, fn)
+	if err != nil {
+		return printError(L, err)
+	}
+	settings, ok := result.(*lua.LTable)
+	if !ok {
+		fmt.Println("Setup didn't return any settings, nothing saved")
+		return statusError
+	}
+	settings.ForEach(func(k, v lua.LValue) {
+		L.SetGlobal(k.String(), v)
+		stateNames[k.String()] = true
+	})
+	values, err := luaToGo(settings)
+	if err != nil {
+		fmt.Println("Error saving settings:", err)
+		return statusError
+	}
+	contents, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		fmt.Println("Error saving settings:", err)
+		return statusError
+	}
+	if err := ioutil.WriteFile(filename, append(contents, '\n'),
+		0600); err != nil {
+		fmt.Println("Error saving settings:", err)
+		return statusError
+	}
+	fmt.Println("Settings saved to", filename)
+	return statusOK
+}
+
+// cliFile is the lua file the cli was started with
+var cliFile string
+
+func Run(luaFile string) int {
+	// Returns the exit status instead of exiting, so that the deferred
+	// cleanup (restoring the terminal, saving history, removing the socket
+	// and temp files) still happens
+	cliFile = luaFile
+	L := newLuaState()
+	luaLock.Lock()
+	cleanupOnSignal()
+	defer removeTempFiles()
+
+	// Each session gets an id for telling sessions apart in logs. Set
+	// SIMPLECLI_SESSION_ID to use a particular id instead.
+	sessionID := os.Getenv("SIMPLECLI_SESSION_ID")
+	if sessionID == "" {
+		sessionID = newUUID(rand.Reader)
+	}
+	L.SetGlobal("_session_id", lua.LString(sessionID))
+
+	// Time spent in each part of startup, for --profile-startup
+	startupTimes := []startupTime{}
+	lastCheckpoint := time.Now()
+	checkpoint := func(step string) {
+		now := time.Now()
+		startupTimes = append(startupTimes,
+			startupTime{step, now.Sub(lastCheckpoint)})
+		lastCheckpoint = now
+	}
+
+	if err := L.DoFile(luaFile); err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	defer L.Close()
+	checkpoint("loading " + luaFile)
+
+	registerLuaFunctions(L)
+	loadPlugins(L)
+	loadState(L)
+	parseCommandLineFlags(L)
+	if _, ok := themes[*themeName]; !ok {
+		fmt.Println("Unknown theme:", *themeName)
+		return 1
+	}
+	checkpoint("parsing flags")
+
+	// Anything after the flags is in _args, as well as being run as a
+	// command (unless --args is given)
+	positional := L.NewTable()
+	for _, arg := range flag.Args() {
+		positional.Append(lua.LString(arg))
+	}
+	L.SetGlobal("_args", positional)
+
+	if *genDocs != "" {
+		return genDocsFile(L, *genDocs, luaFile, flag.Arg(0))
+	}
+
+	historyPath = historyFile(L, luaFile)
+	loadHistoryLines()
+	resized := make(chan struct{}, 1)
 	rl, err := readline.NewEx(&readline.Config{
 		Prompt:          "> ",
 		InterruptPrompt: "^C",
 		EOFPrompt:       "exit",
+		HistoryFile:     historyPath,
+		Stdin:           readline.NewCancelableStdin(gatedStdin{}),
+		FuncOnWidthChanged: func(f func()) {
+			// Keep readline's own resize handling, but let us know too
+			readline.DefaultOnWidthChanged(func() {
+				f()
+				select {
+				case resized <- struct{}{}:
+				default:
+				}
+			})
+		},
 	})
 	if err != nil {
 		fmt.Println(err.Error())
-		os.Exit(1)
+		return 1
 	}
 	defer rl.Close()
+	lineReader = rl
 
-	L := lua.NewState()
-	if err = L.DoFile(luaFile); err != nil {
-		fmt.Println(err.Error())
-		os.Exit(1)
+	// The first time the cli is used at a terminal, the setup function (if
+	// there is one) asks for the settings it needs
+	if term.IsTerminal(int(os.Stdin.Fd())) && *scriptFile == "" &&
+		*replayFile == "" && needsSetup(L) {
+		runSetup(L)
 	}
-	defer L.Close()
-
-	registerLuaFunctions(L)
-	parseCommandLineFlags(L)
-	setupAutocomplete(rl, L)
 
-	// The banner function lets you print some text when the CLI starts
-	bannerfn := L.GetGlobal("banner")
-	if bannerfn.Type() == lua.LTFunction {
+	// The on_start function is for any setup that needs to happen before the
+	// first command, such as logging in. If it fails we exit with
+	// _on_start_exit_code (default 1), or carry on if that's set to 0.
+	startfn := L.GetGlobal("on_start")
+	if startfn.Type() == lua.LTFunction {
 		if err = L.CallByParam(lua.P{
-			Fn:      bannerfn,
-			NRet:    1,
+			Fn:      startfn,
+			NRet:    0,
 			Protect: true,
 		}); err != nil {
 			fmt.Println(err.Error())
+			exitCode := 1
+			if n, ok := L.GetGlobal("_on_start_exit_code").(lua.LNumber); ok {
+				exitCode = int(n)
+			}
+			if exitCode != 0 {
+				return exitCode
+			}
 		}
-		fmt.Println(L.Get(-1).String())
-		L.Pop(1)
 	}
+	checkpoint("on_start")
 
-	// Set a prompt function to customize the prompt
-	promptfn := L.GetGlobal("prompt")
-	for {
-		if promptfn.Type() == lua.LTFunction {
-			if err = L.CallByParam(lua.P{
-				Fn:      promptfn,
-				NRet:    1,
-				Protect: true,
-			}); err != nil {
-				fmt.Println(err.Error())
+	if *profileStartup {
+		var total time.Duration
+		for _, t := range startupTimes {
+			fmt.Fprintf(os.Stderr, "%-30s %s\n", t.step, t.duration)
+			total += t.duration
+		}
+		fmt.Fprintf(os.Stderr, "%-30s %s\n", "total", total)
+	}
+
+	// Scripts given with --eval-file get the same helpers as the cli, but are
+	// run once instead of starting the interactive loop
+	if *evalFile != "" {
+		return evalLuaFile(L, *evalFile)
+	}
+
+	// A command given after the config file and flags is run once, with
+	// stdin left for the command to use, instead of starting the interactive
+	// loop
+	if flag.NArg() > 0 && !*argsOnly {
+		return exitCode(L, dispatchArgs(L, flag.Args()))
+	}
+
+	// Other programs can run commands by connecting to the control socket.
+	// Without a terminal, that's the only place commands come from.
+	if *controlSocket != "" {
+		os.Remove(*controlSocket)
+		listener, err := net.Listen("unix", *controlSocket)
+		if err != nil {
+			fmt.Println("Error listening on control socket:", err)
+			return 1
+		}
+		defer os.Remove(*controlSocket)
+		defer listener.Close()
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			luaLock.Unlock()
+			serveControlSocket(L, listener)
+			return 0
+		}
+		go serveControlSocket(L, listener)
+	}
+
+	if *recordFile != "" {
+		f, err := os.OpenFile(*recordFile,
+			os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			fmt.Println("Error opening recording:", err)
+			return 1
+		}
+		defer f.Close()
+		recording = json.NewEncoder(f)
+	}
+	if *replayFile != "" {
+		return replay(L, *replayFile)
+	}
+
+	// Commands from a --script file, or piped in, are run one after another
+	// without a prompt
+	if *scriptFile != "" {
+		f, err := os.Open(*scriptFile)
+		if err != nil {
+			fmt.Println("Error opening script:", err)
+			return 1
+		}
+		defer f.Close()
+		return runScript(L, f)
+	} else if !term.IsTerminal(int(os.Stdin.Fd())) {
+		stdinScript = true
+		return runScript(L, os.Stdin)
+	}
+
+	setupAutocomplete(rl, L)
+	completer := rl.Config.AutoComplete
+
+	showBanner(L)
+
+	// The prompt is redrawn while waiting for input when the terminal is
+	// resized (it may depend on the width), or when cli_prompt_dirty says
+	// it's out of date. On resize, on_resize is called too if there is one.
+	// SIGHUP reloads the lua file, like the reload built in.
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-hangup:
+				luaLock.Lock()
+				fmt.Println()
+				reloadCli(L)
+			case <-resized:
+				luaLock.Lock()
+				resizefn := L.GetGlobal("on_resize")
+				if resizefn.Type() == lua.LTFunction {
+					width, height := terminalSize()
+					if err := L.CallByParam(lua.P{
+						Fn:      resizefn,
+						NRet:    0,
+						Protect: true,
+					}, lua.LNumber(width), lua.LNumber(height)); err != nil {
+						fmt.Println(err.Error())
+					}
+				}
+			case <-promptDirty:
+				luaLock.Lock()
 			}
-			rl.SetPrompt(L.Get(-1).String())
-			L.Pop(1)
+			updatePrompt(L, rl)
+			rl.Refresh()
+			luaLock.Unlock()
 		}
-		line, err := rl.Readline()
+	}()
+
+	openStdin()
+	// A line ending in a backslash carries on onto the next line
+	pending := ""
+	for {
+		applySettings(L, rl, completer)
+		updatePrompt(L, rl)
+		next := prefill
+		prefill = ""
+		luaLock.Unlock()
+		line, err := rl.ReadlineWithDefault(next)
+		luaLock.Lock()
 		// Deal with ^C and ^D
 		if err == readline.ErrInterrupt {
+			// ^C also cancels anything waiting for input from cli_expect,
+			// or a line being continued
+			expecting = nil
+			if continuing {
+				pending, continuing = "", false
+				continue
+			}
 			if len(line) == 0 {
 				break
 			} else {
@@ -79,141 +594,3357 @@ func Run(luaFile string) {
 		} else if err == io.EOF {
 			break
 		}
-
-		line = strings.TrimSpace(line)
-		if line == "" {
+		if strings.HasSuffix(line, "\\") {
+			pending += strings.TrimSuffix(line, "\\")
+			continuing = true
 			continue
 		}
-		parts, err := shlex.Split(line)
-		if err != nil {
-			fmt.Println("Error splitting up command string:", err)
-			continue
+		line = pending + line
+		pending, continuing = "", false
+
+		runLine(L, line, true)
+		if exitRequested {
+			break
 		}
+	}
+	return 0
+}
 
-		cmd, args := parts[0], parts[1:]
+func runLine(L *lua.LState, line string, remember bool) commandStatus {
+	// Runs a line of input, adding it to the history if remember is set
 
-		// Help for commands is implemented in the help_foo
-		if cmd == "help" {
-			if len(args) == 0 {
-				printCommands(L)
-				continue
-			} else {
-				helpText := L.GetGlobal("help_" + args[0])
-				if helpText.Type() != lua.LTString {
-					fmt.Println("No help for command:", args[0])
-					continue
-				}
-				helpString := strings.TrimSpace(helpText.String())
-				helpLines := strings.Split(helpString, "\n")
-				for _, line := range helpLines {
-					fmt.Println(strings.TrimSpace(line))
-				}
-				continue
-			}
-		}
+	// Don't try to parse huge accidental pastes. The limit can be
+	// changed with max_line_length, and 0 turns it off.
+	maxLength := 65536
+	if n, ok := L.GetGlobal("max_line_length").(lua.LNumber); ok {
+		maxLength = int(n)
+	}
+	if maxLength > 0 && len(line) > maxLength {
+		fmt.Printf("Line too long (%d characters, the limit is %d). "+
+			"For large input, put it in a file and read it from your "+
+			"command instead.\n", len(line), maxLength)
+		return statusUsage
+	}
 
-		// Convert args into a lua table
-		argsTable := &lua.LTable{}
-		for _, arg := range args {
-			argsTable.Append(lua.LString(arg))
+	// A command can ask for the next line to be given to a function with
+	// cli_expect, instead of it being run as a command
+	if expecting != nil {
+		fn := expecting
+		expecting = nil
+		if _, err := callCommand(L, fn, lua.LString(line)); err != nil {
+			fmt.Println(err.Error())
+			return statusError
 		}
+		return statusOK
+	}
 
-		fn, ok := L.GetGlobal("do_" + cmd).(*lua.LFunction)
-		if !ok {
-			fmt.Println("Unknown command:", cmd)
-			continue
+	if remember {
+		addHistoryLine(line)
+	}
+	start := time.Now()
+	if recording != nil {
+		recordOutput = &bytes.Buffer{}
+	}
+	status := dispatch(L, line)
+	if recording != nil {
+		output := recordOutput.String()
+		recordOutput = nil
+		if err := recording.Encode(recordedCommand{line, &output}); err != nil {
+			fmt.Println("Error saving recording:", err)
 		}
+	}
+	if remember && status == statusOK &&
+		!strings.HasPrefix(strings.TrimSpace(line), "transcript") {
+		transcript = append(transcript, transcriptLine{start, line})
+	}
+	return status
+}
 
-		if fn.Proto.NumParameters == 2 {
-			// A function can take a third parameter, which will be a filename
-			// for a temporary file. We only want to make it though if the
-			// function will use it.
-			tmpfile, err := ioutil.TempFile("", "simplecli")
-			if err != nil {
-				fmt.Println(err)
-				continue
-			}
-			tmpfilename := tmpfile.Name()
-			// We don't use the file directly, so close it
-			tmpfile.Close()
-			if err = L.CallByParam(lua.P{
-				Fn:      fn,
-				NRet:    0,
-				Protect: true,
-			}, argsTable, lua.LString(tmpfilename)); err != nil {
-				fmt.Println(err.Error())
-			}
-			os.Remove(tmpfilename)
-		} else {
-			if err = L.CallByParam(lua.P{
-				Fn:      fn,
-				NRet:    0,
-				Protect: true,
-			}, argsTable); err != nil {
-				fmt.Println(err.Error())
-			}
+// transcript is the commands typed this session that succeeded, for the
+// transcript built in
+var transcript []transcriptLine
+
+type transcriptLine struct {
+	time time.Time
+	line string
+}
+
+func transcriptCommand(args []string) commandStatus {
+	// Shows the commands that succeeded this session, or with --shell FILE
+	// writes them to a script that runs them again with --script.
+	// --timestamps adds when each was run as a comment.
+	filename := ""
+	timestamps := false
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--shell" && i+1 < len(args):
+			filename = args[i+1]
+			i++
+		case args[i] == "--timestamps":
+			timestamps = true
+		default:
+			fmt.Println("Usage: transcript [--shell FILE] [--timestamps]")
+			return statusUsage
+		}
+	}
+	var b strings.Builder
+	if filename != "" {
+		exe, err := os.Executable()
+		if err != nil {
+			exe = os.Args[0]
+		}
+		config, err := filepath.Abs(cliFile)
+		if err != nil {
+			config = cliFile
 		}
+		fmt.Fprintf(&b, "#!/usr/bin/env -S %s --script\n",
+			shellJoin([]string{exe, config}))
+	}
+	for _, t := range transcript {
+		if timestamps {
+			fmt.Fprintf(&b, "# %s\n", t.time.Format("2006-01-02 15:04:05"))
+		}
+		fmt.Fprintln(&b, t.line)
+	}
+	if filename == "" {
+		fmt.Print(b.String())
+		return statusOK
+	}
+	if err := ioutil.WriteFile(filename, []byte(b.String()), 0755); err != nil {
+		fmt.Println("Error writing transcript:", err)
+		return statusError
 	}
+	fmt.Printf("Wrote %d commands to %s\n", len(transcript), filename)
+	return statusOK
 }
 
-func printCommands(L *lua.LState) {
-	commands := []string{}
-	globals := L.Get(lua.GlobalsIndex).(*lua.LTable)
-	globals.ForEach(func(klv lua.LValue, v lua.LValue) {
-		k := klv.String()
-		if v.Type() == lua.LTFunction && strings.HasPrefix(k, "do_") {
-			commands = append(commands, k[3:])
+// recordedCommand is a line in a --record file. Output can be left out of
+// files written by hand, to run the commands without checking them.
+type recordedCommand struct {
+	Input  string  `json:"input"`
+	Output *string `json:"output,omitempty"`
+}
+
+// recording is where commands are saved with --record, and recordOutput
+// collects the output of the command that's running
+var recording *json.Encoder
+var recordOutput *bytes.Buffer
+
+func replay(L *lua.LState, filename string) int {
+	// Runs the commands in a recording, and shows a diff for any whose
+	// output is different this time. Exits with the assert exit code if
+	// there were any differences.
+	f, err := os.Open(filename)
+	if err != nil {
+		fmt.Println("Error opening recording:", err)
+		return 1
+	}
+	defer f.Close()
+	decoder := json.NewDecoder(f)
+	failed := 0
+	for n := 1; decoder.More(); n++ {
+		var cmd recordedCommand
+		if err := decoder.Decode(&cmd); err != nil {
+			fmt.Println("Error reading recording:", err)
+			return 1
 		}
-	})
-	sort.Strings(commands)
-	fmt.Println("Available commands:")
-	for _, v := range commands {
-		fmt.Println(v)
+		capture := recording
+		recording = nil
+		recordOutput = &bytes.Buffer{}
+		runLine(L, cmd.Input, false)
+		output := recordOutput.String()
+		recordOutput = nil
+		recording = capture
+		if cmd.Output == nil || output == *cmd.Output {
+			continue
+		}
+		failed++
+		fmt.Println(colorize(L, "error",
+			fmt.Sprintf("Output of command %d (%s) is different:", n, cmd.Input)))
+		diff := diffLines(
+			strings.Split(strings.TrimRight(*cmd.Output, "\n"), "\n"),
+			strings.Split(strings.TrimRight(output, "\n"), "\n"))
+		for _, l := range diff {
+			fmt.Println(l)
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("%d commands had different output\n", failed)
+		return exitCode(L, statusAssert)
 	}
+	return 0
 }
 
-func parseCommandLineFlags(L *lua.LState) {
-	// Go through all globals and identify any variables we've configured,
-	// making them available as flags
-	stringArgs := map[string]*string{}
-	numArgs := map[string]*float64{}
-	boolArgs := map[string]*bool{}
+// runningScript is set while runScript is going, so commands listed in the
+// quiet table (or all of them, with --quiet-all) can keep quiet
+var runningScript bool
 
-	globals := L.Get(lua.GlobalsIndex).(*lua.LTable)
-	globals.ForEach(func(klv lua.LValue, v lua.LValue) {
-		k := klv.String()
-		if strings.HasPrefix(k, "_") {
-			// Skip internal variables
-			return
+func runScript(L *lua.LState, r io.Reader) int {
+	// Runs each line of a script as a command, and returns the exit code for
+	// the last one. Lines starting with # are comments, and lines ending in
+	// a backslash carry on onto the next line as they do at the prompt.
+	// With --stop-on-error, the script stops at the first command that
+	// fails.
+	runningScript = true
+	defer func() { runningScript = false }()
+	status := statusOK
+	pending := ""
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasSuffix(line, "\\") {
+			pending += strings.TrimSuffix(line, "\\")
+			continue
 		}
-		if strings.HasPrefix(k, "help_") {
-			// Skip help text
-			return
+		line = strings.TrimSpace(pending + line)
+		pending = ""
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
 		}
-		switch t := v.Type(); t {
-		case lua.LTString:
-			stringArgs[k] = flag.String(k, v.String(), "Set "+k)
-		case lua.LTNumber:
-			num := float64(v.(lua.LNumber))
-			numArgs[k] = flag.Float64(k, num, "Set "+k)
-		case lua.LTBool:
-			boolArgs[k] = flag.Bool(k, lua.LVAsBool(v), "Set "+k)
+		status = runLine(L, line, false)
+		if (status != statusOK && stopOnError) || exitRequested {
+			break
 		}
-	})
-	flag.Parse()
-	for k, v := range stringArgs {
-		L.SetGlobal(k, lua.LString(*v))
 	}
-	for k, v := range numArgs {
-		L.SetGlobal(k, lua.LNumber(*v))
-	}
-	for k, v := range boolArgs {
-		L.SetGlobal(k, lua.LBool(*v))
+	if err := scanner.Err(); err != nil {
+		fmt.Println("Error reading script:", err)
+		return 1
 	}
+	return exitCode(L, status)
 }
 
-func cliVariable(L *lua.LState) int {
-	varname := L.ToString(1)
+func serveControlSocket(L *lua.LState, listener net.Listener) {
+	// Runs each line sent to the socket as a command, and sends the output
+	// back. Lua can only do one thing at a time, so connections are handled
+	// one after another, and commands wait for the prompt to be idle. Lines
+	// go through runLine like typed ones, so they're checked, recorded and
+	// kept in the history the same way.
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			luaLock.Lock()
+			captureOutput(conn, func() {
+				runLine(L, scanner.Text(), true)
+			})
+			// "exit" from a connection ends the connection, not the cli
+			done := exitRequested
+			exitRequested = false
+			luaLock.Unlock()
+			if done {
+				break
+			}
+		}
+		conn.Close()
+	}
+}
+
+// exitRequested is set when a command returns "exit"
+var exitRequested bool
+
+// historyPath is the file history is saved in, or "" if it isn't saved
+var historyPath string
+
+// historyLines is a copy of the readline history, which readline doesn't
+// give us a way to read, for cli_history
+var historyLines []string
+
+func loadHistoryLines() {
+	if historyPath == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(historyPath)
+	if err != nil {
+		return
+	}
+	historyLines = strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(historyLines) == 1 && historyLines[0] == "" {
+		historyLines = nil
+	}
+}
+
+func addHistoryLine(line string) {
+	// Readline doesn't save a line that's the same as the one before it, so
+	// neither do we
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	if n := len(historyLines); n > 0 && historyLines[n-1] == line {
+		return
+	}
+	historyLines = append(historyLines, line)
+}
+
+// expecting is the function set by cli_expect to handle the next line of
+// input, if any
+var expecting *lua.LFunction
+
+func showBanner(L *lua.LState) {
+	// The banner lets you print some text when the CLI starts. It can be a
+	// template file named in banner_file, a banner function, or a string.
+	if text, ok := renderGlobalTemplateFile(L, "banner_file"); ok {
+		fmt.Println(strings.TrimRight(text, "\n"))
+		return
+	}
+	bannerfn := L.GetGlobal("banner")
+	switch bannerfn.Type() {
+	case lua.LTFunction:
+		if err := L.CallByParam(lua.P{
+			Fn:      bannerfn,
+			NRet:    1,
+			Protect: true,
+		}); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		fmt.Println(L.Get(-1).String())
+		L.Pop(1)
+	case lua.LTString:
+		fmt.Println(bannerfn.String())
+	}
+}
+
+// promptDirty is signalled by cli_prompt_dirty when the prompt needs to be
+// redrawn
+var promptDirty = make(chan struct{}, 1)
+
+func cliPromptDirty(L *lua.LState) int {
+	// Asks for the prompt to be redrawn, for prompts showing state that has
+	// changed. This happens as soon as the cli is waiting for input.
+	select {
+	case promptDirty <- struct{}{}:
+	default:
+	}
+	return 0
+}
+
+// continuing is set while reading the rest of a line that ended in a
+// backslash
+var continuing bool
+
+func updatePrompt(L *lua.LState, rl *readline.Instance) {
+	// The prompt can be customized with a template file named in
+	// prompt_file, a prompt function, or a string
+	if continuing {
+		rl.SetPrompt(colorize(L, "prompt", "... "))
+		return
+	}
+	if text, ok := renderGlobalTemplateFile(L, "prompt_file"); ok {
+		rl.SetPrompt(colorize(L, "prompt", strings.TrimRight(text, "\n")))
+		return
+	}
+	promptfn := L.GetGlobal("prompt")
+	switch promptfn.Type() {
+	case lua.LTFunction:
+		if err := L.CallByParam(lua.P{
+			Fn:      promptfn,
+			NRet:    1,
+			Protect: true,
+		}); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		rl.SetPrompt(colorize(L, "prompt", L.Get(-1).String()))
+		L.Pop(1)
+	case lua.LTString:
+		rl.SetPrompt(colorize(L, "prompt", promptfn.String()))
+	default:
+		// Put the default back, in case a command asked for input
+		rl.SetPrompt(colorize(L, "prompt", settings["prompt"].String()))
+	}
+}
+
+// lineReader is the readline instance, for commands that ask for input
+var lineReader *readline.Instance
+
+func promptLine(message string, def string) (string, bool) {
+	// Reads a line of input from inside a command, returning false on ^C or
+	// EOF. Completion is turned off while it's waiting (it needs the lua
+	// lock, which the command has), and answers aren't added to the history.
+	// The prompt is put back by updatePrompt before the next command.
+	openStdin()
+	completer := lineReader.Config.AutoComplete
+	lineReader.Config.AutoComplete = &readline.TabCompleter{}
+	lineReader.HistoryDisable()
+	defer func() {
+		lineReader.Config.AutoComplete = completer
+		lineReader.HistoryEnable()
+	}()
+	lineReader.SetPrompt(message)
+	line, err := lineReader.ReadlineWithDefault(def)
+	if err != nil {
+		return "", false
+	}
+	return line, true
+}
+
+// prefill is the text cli_prefill asked to start the next prompt with
+var prefill string
+
+func cliPrefill(L *lua.LState) int {
+	// Starts the next command line with some text in it, which can be
+	// edited before pressing enter, e.g. to suggest a command to run next
+	prefill = L.CheckString(1)
+	return 0
+}
+
+func cliPrompt(L *lua.LState) int {
+	// Asks for a line of input, optionally with a default already filled
+	// in. Returns nil if ^C is pressed.
+	line, ok := promptLine(L.CheckString(1), L.OptString(2, ""))
+	if !ok {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(lua.LString(line))
+	return 1
+}
+
+func cliPromptNumber(L *lua.LState) int {
+	// Asks for a number, asking again (up to three times) if the answer
+	// isn't a number or is outside of min and max. An empty answer gives
+	// the default if there is one. Returns nil if ^C is pressed or there
+	// are too many bad answers.
+	message := L.CheckString(1)
+	opts := L.OptTable(2, L.NewTable())
+	min, hasMin := L.GetField(opts, "min").(lua.LNumber)
+	max, hasMax := L.GetField(opts, "max").(lua.LNumber)
+	def, hasDef := L.GetField(opts, "default").(lua.LNumber)
+	for tries := 0; tries < 3; tries++ {
+		line, ok := promptLine(message, "")
+		if !ok {
+			break
+		}
+		line = strings.TrimSpace(line)
+		if line == "" && hasDef {
+			L.Push(def)
+			return 1
+		}
+		f, err := strconv.ParseFloat(line, 64)
+		switch {
+		case err != nil:
+			fmt.Println("Please enter a number")
+		case hasMin && lua.LNumber(f) < min:
+			fmt.Println("Please enter a number no less than", min)
+		case hasMax && lua.LNumber(f) > max:
+			fmt.Println("Please enter a number no more than", max)
+		default:
+			L.Push(lua.LNumber(f))
+			return 1
+		}
+	}
+	L.Push(lua.LNil)
+	return 1
+}
+
+func cliConfirm(L *lua.LState) int {
+	// Asks a yes or no question, returning true only if the answer is y or
+	// yes. Anything else, including ^C, counts as no.
+	line, ok := promptLine(L.CheckString(1)+" [y/N] ", "")
+	answer := strings.ToLower(strings.TrimSpace(line))
+	L.Push(lua.LBool(ok && (answer == "y" || answer == "yes")))
+	return 1
+}
+
+// settings are the globals cli_config can read and change, with their
+// defaults
+var settings = map[string]lua.LValue{
+	"prompt":        lua.LString("> "),
+	"vi_mode":       lua.LFalse,
+	"history_limit": lua.LNumber(500),
+	"autocomplete":  lua.LTrue,
+}
+
+func setting(L *lua.LState, key string) lua.LValue {
+	if v := L.GetGlobal(key); v != lua.LNil {
+		return v
+	}
+	return settings[key]
+}
+
+func applySettings(L *lua.LState, rl *readline.Instance,
+	completer readline.AutoCompleter) {
+	// Updates readline from the settings globals before each prompt. The
+	// prompt itself is handled by updatePrompt.
+	if vi := lua.LVAsBool(setting(L, "vi_mode")); vi != rl.IsVimMode() {
+		rl.SetVimMode(vi)
+	}
+	if n, ok := setting(L, "history_limit").(lua.LNumber); ok {
+		rl.Config.HistoryLimit = int(n)
+	}
+	if lua.LVAsBool(setting(L, "autocomplete")) {
+		rl.Config.AutoComplete = completer
+	} else {
+		// readline's default, which just inserts a tab
+		rl.Config.AutoComplete = &readline.TabCompleter{}
+	}
+}
+
+func cliConfig(L *lua.LState) int {
+	// Returns a setting, after changing it if a value is given. Changes take
+	// effect at the next prompt.
+	key := L.CheckString(1)
+	def, ok := settings[key]
+	if !ok {
+		L.ArgError(1, "unknown setting "+key)
+	}
+	if L.GetTop() >= 2 && L.Get(2) != lua.LNil {
+		value := L.Get(2)
+		switch {
+		case key == "prompt" && value.Type() == lua.LTFunction:
+		case value.Type() != def.Type():
+			L.ArgError(2, fmt.Sprintf("%s must be a %s", key, def.Type()))
+		}
+		L.SetGlobal(key, value)
+	}
+	L.Push(setting(L, key))
+	return 1
+}
+
+func terminalSize() (int, int) {
+	// Returns the width and height of the terminal, or a standard 80x24 if
+	// stdout isn't a terminal
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		return 80, 24
+	}
+	return width, height
+}
+
+// commandDepth is how many commands are currently being run. Commands that
+// run other commands increase it, and max_command_depth stops them from
+// recursing forever.
+var commandDepth = 0
+
+// commandStatus is the outcome of running a command line
+type commandStatus int
+
+const (
+	statusOK         commandStatus = iota
+	statusError                    // The command raised an error
+	statusUsage                    // The command line couldn't be parsed
+	statusValidation               // validate_input rejected the line
+	statusUnknown                  // There's no such command
+	statusAssert                   // A cli_assert failed
+	statusDenied                   // The command isn't allowed
+)
+
+// exitCodes are the default exit codes for each status, along with the name
+// used to override them in the exit_codes table
+var exitCodes = map[commandStatus]struct {
+	name string
+	code int
+}{
+	statusOK:         {"ok", 0},
+	statusError:      {"error", 1},
+	statusUsage:      {"usage", 2},
+	statusValidation: {"validation", 1},
+	statusUnknown:    {"unknown_command", 127},
+	statusAssert:     {"assert", 1},
+	statusDenied:     {"permission_denied", 126},
+}
+
+func exitCode(L *lua.LState, status commandStatus) int {
+	// Returns the exit code to use when a command fails in a
+	// non-interactive mode. Set these in the exit_codes table to change them,
+	// e.g. exit_codes = {unknown_command = 3}.
+	code := exitCodes[status]
+	if codes, ok := L.GetGlobal("exit_codes").(*lua.LTable); ok {
+		if n, ok := L.GetField(codes, code.name).(lua.LNumber); ok {
+			return int(n)
+		}
+	}
+	return code.code
+}
+
+func dispatch(L *lua.LState, line string) commandStatus {
+	// Runs a line of input. As in the shell, several commands can be joined
+	// with ; to run one after the other, && to only run the next one if the
+	// last succeeded, and || to only run it if the last failed. The status
+	// is the last command that was run's.
+	commands, operators := splitChain(line)
+	for i, op := range operators {
+		if op != ";" && (strings.TrimSpace(commands[i]) == "" ||
+			strings.TrimSpace(commands[i+1]) == "") {
+			fmt.Println("Missing command next to", op)
+			return statusUsage
+		}
+	}
+	status := dispatchCommand(L, commands[0])
+	for i, op := range operators {
+		if exitRequested {
+			break
+		}
+		if (op == "&&" && status != statusOK) ||
+			(op == "||" && status == statusOK) {
+			continue
+		}
+		status = dispatchCommand(L, commands[i+1])
+	}
+	return status
+}
+
+func splitChain(line string) ([]string, []string) {
+	// Splits a line on ;, && and || outside of quotes, options tables (lua
+	// tables can use ; between fields) and comments, returning the commands
+	// and the operators between them
+	commands, operators := []string{}, []string{}
+	found := unquoted(line, ";&|")
+	start := 0
+	for i := 0; i < len(found); i++ {
+		pos := found[i]
+		if line[pos] == ';' {
+			commands = append(commands, line[start:pos])
+			operators = append(operators, ";")
+			start = pos + 1
+		} else if i+1 < len(found) && found[i+1] == pos+1 &&
+			line[pos+1] == line[pos] {
+			commands = append(commands, line[start:pos])
+			operators = append(operators, line[pos:pos+2])
+			i++
+			start = pos + 2
+		}
+	}
+	return append(commands, line[start:]), operators
+}
+
+func enterCommand(L *lua.LState, line string) (func(), bool) {
+	// Keeps track of commands that run other commands, refusing to go
+	// deeper than max_command_depth. The returned function is called once
+	// the command has finished.
+	maxDepth := 10
+	if n, ok := L.GetGlobal("max_command_depth").(lua.LNumber); ok {
+		maxDepth = int(n)
+	}
+	if commandDepth >= maxDepth {
+		fmt.Println("Maximum command depth exceeded, not running:", line)
+		return nil, false
+	}
+	commandDepth++
+	L.SetGlobal("_command_depth", lua.LNumber(commandDepth))
+	return func() {
+		commandDepth--
+		L.SetGlobal("_command_depth", lua.LNumber(commandDepth))
+	}, true
+}
+
+func dispatchCommand(L *lua.LState, line string) commandStatus {
+	leave, ok := enterCommand(L, line)
+	if !ok {
+		return statusError
+	}
+	defer leave()
+
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return statusOK
+	}
+
+	// The parse built in shows how the rest of the line would be run, so it
+	// needs the line before anything has been done to it
+	if strings.Fields(line)[0] == "parse" &&
+		L.GetGlobal("do_parse") == lua.LNil {
+		if !commandAllowed(L, "parse") {
+			fmt.Println("Permission denied: parse")
+			return statusDenied
+		}
+		return parseCommand(L, strings.TrimSpace(line[len("parse"):]))
+	}
+
+	parsed, status := parseLine(L, line)
+	if parsed == nil {
+		return status
+	}
+	return runParsed(L, parsed)
+}
+
+func dispatchArgs(L *lua.LState, args []string) commandStatus {
+	// Runs a command that has already been split into arguments, such as
+	// one given on the command line. The shell (or whatever split it up)
+	// has dealt with quoting, so there's no chaining, redirecting, piping
+	// or options table to look for, and an argument like ";" or ">" is
+	// passed to the command as it is.
+	if len(args) == 0 {
+		return statusOK
+	}
+	leave, ok := enterCommand(L, shellJoin(args))
+	if !ok {
+		return statusError
+	}
+	defer leave()
+	parsed, status := parseArgs(L, args)
+	if parsed == nil {
+		return status
+	}
+	return runParsed(L, parsed)
+}
+
+func runParsed(L *lua.LState, parsed *parsedLine) commandStatus {
+	// Runs a command that has been parsed, sending its output wherever the
+	// line said to
+	status := statusOK
+	cmd, args, opts, pipeline := parsed.cmd, parsed.args, parsed.opts,
+		parsed.pipeline
+	// The command has to be allowed before anything it's piped to is
+	// started or its output file is opened. Piping to programs at all needs
+	// "|" in the allowed list, and redirecting to a file needs ">".
+	if !commandAllowed(L, cmd) {
+		fmt.Println("Permission denied:", cmd)
+		writeAuditEvent(L, cmd, args, 0, statusDenied)
+		return statusDenied
+	}
+	if len(pipeline) > 0 && !commandAllowed(L, "|") {
+		fmt.Println("Permission denied: |")
+		writeAuditEvent(L, cmd, args, 0, statusDenied)
+		return statusDenied
+	}
+	if parsed.redirect != "" && !commandAllowed(L, ">") {
+		fmt.Println("Permission denied: >")
+		writeAuditEvent(L, cmd, args, 0, statusDenied)
+		return statusDenied
+	}
+	var redirect *os.File
+	if parsed.redirect != "" {
+		mode := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if parsed.appending {
+			mode = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		}
+		var err error
+		redirect, err = os.OpenFile(parsed.redirect, mode, 0644)
+		if err != nil {
+			fmt.Println("Error opening output file:", err)
+			return statusError
+		}
+		defer redirect.Close()
+	}
+
+	// Commands typed at the prompt can have their output sent elsewhere as
+	// well as (or instead of) the terminal
+	start := time.Now()
+	if len(pipeline) > 0 {
+		out := io.Writer(os.Stdout)
+		if redirect != nil {
+			out = redirect
+		}
+		if err := pipeOutput(pipeline, out, func() {
+			status = runCommand(L, cmd, args, opts)
+		}); err != nil {
+			fmt.Println("Error running pipe:", err)
+			status = statusError
+		}
+	} else if redirect != nil {
+		captureOutput(redirect, func() {
+			status = runCommand(L, cmd, args, opts)
+		})
+	} else if quietCommand(L, cmd) {
+		// The output is only shown if the command fails, so the error has
+		// some context
+		buf := &bytes.Buffer{}
+		captureOutput(buf, func() {
+			status = runCommand(L, cmd, args, opts)
+		})
+		if status != statusOK {
+			os.Stdout.Write(buf.Bytes())
+		}
+	} else if w, done := commandOutput(L); w != nil {
+		captureOutput(w, func() {
+			status = runCommand(L, cmd, args, opts)
+		})
+		done()
+	} else {
+		status = runCommand(L, cmd, args, opts)
+	}
+	writeAuditEvent(L, cmd, args, time.Since(start), status)
+	if status == statusOK && cmd != "error" {
+		lastError.message, lastError.traceback = "", ""
+	}
+	return status
+}
+
+func quietCommand(L *lua.LState, cmd string) bool {
+	// Returns true if the output of a command in a script should be hidden
+	if !runningScript || commandDepth > 1 {
+		return false
+	}
+	if *quietAll {
+		return true
+	}
+	quiet, ok := L.GetGlobal("quiet").(*lua.LTable)
+	return ok && lua.LVAsBool(L.GetField(quiet, cmd))
+}
+
+// parsedLine is a line of input split up into what to run
+type parsedLine struct {
+	cmd       string
+	args      []string
+	opts      *lua.LTable
+	redirect  string
+	appending bool
+	pipeline  [][]string
+}
+
+func parseLine(L *lua.LState, line string) (*parsedLine, commandStatus) {
+	// Does everything to a line that happens before the command is run:
+	// validation, expansion, splitting it up and finding the command. If the
+	// line shouldn't be run, it returns nil and the status to give instead.
+	if status := validateLine(L, line); status != statusOK {
+		return nil, status
+	}
+
+	// With _expand_env set, $VAR and ${VAR} are replaced with environment
+	// variables, except inside single quotes
+	if lua.LVAsBool(L.GetGlobal("_expand_env")) {
+		line = expandEnv(line,
+			lua.LVAsBool(L.GetGlobal("_expand_env_keep_unknown")))
+	}
+
+	// Output can be sent to a file with > file, or added to the end of one
+	// with >> file
+	line, filename, appending := splitRedirect(line)
+	// It can also be piped into other programs with | program
+	line, stages := splitPipeline(line)
+	pipeline := [][]string{}
+	for _, stage := range stages {
+		program, err := shlex.Split(stage)
+		if err != nil {
+			fmt.Println("Error splitting up command string:", err)
+			return nil, statusUsage
+		}
+		if len(program) == 0 {
+			fmt.Println("Missing program after |")
+			return nil, statusUsage
+		}
+		pipeline = append(pipeline, program)
+	}
+
+	line, opts := splitOptions(L, line)
+	parts, err := shlex.Split(line)
+	if err != nil {
+		fmt.Println("Error splitting up command string:", err)
+		return nil, statusUsage
+	}
+
+	if len(parts) == 0 {
+		if filename != "" {
+			fmt.Println("No command to redirect")
+			return nil, statusUsage
+		}
+		if len(pipeline) > 0 {
+			fmt.Println("No command to pipe from")
+			return nil, statusUsage
+		}
+		// The line was just a comment
+		return nil, statusOK
+	}
+
+	parsed, status := findCommand(L, parts)
+	if parsed != nil {
+		parsed.opts, parsed.pipeline = opts, pipeline
+		parsed.redirect, parsed.appending = filename, appending
+	}
+	return parsed, status
+}
+
+func parseArgs(L *lua.LState, args []string) (*parsedLine, commandStatus) {
+	// Like parseLine, but for a command that has already been split into
+	// arguments. It's still validated, with the arguments quoted back into
+	// a line for validate_input.
+	if status := validateLine(L, shellJoin(args)); status != statusOK {
+		return nil, status
+	}
+	return findCommand(L, append([]string{}, args...))
+}
+
+func validateLine(L *lua.LState, line string) commandStatus {
+	// The validate_input function can reject a line before it's run by
+	// returning an error message
+	validatefn := L.GetGlobal("validate_input")
+	if validatefn.Type() == lua.LTFunction {
+		if err := L.CallByParam(lua.P{
+			Fn:      validatefn,
+			NRet:    1,
+			Protect: true,
+		}, lua.LString(line)); err != nil {
+			fmt.Println(err.Error())
+			return statusError
+		}
+		ret := L.Get(-1)
+		L.Pop(1)
+		if ret.Type() == lua.LTString {
+			fmt.Println(ret.String())
+			return statusValidation
+		}
+	}
+	return statusOK
+}
+
+func findCommand(L *lua.LState, parts []string) (*parsedLine, commandStatus) {
+	// Works out which command the words of a line are for, and expands
+	// its arguments
+	cmd, args := splitCommand(L, parts)
+	cmd, matches := matchPrefix(L, cmd)
+	if len(matches) > 1 {
+		fmt.Printf("Ambiguous command: %s (could be %s)\n", cmd,
+			strings.Join(matches, ", "))
+		return nil, statusUnknown
+	}
+
+	// With _expand_last set, $_ in an argument is replaced with the output
+	// of the previous command
+	if lua.LVAsBool(L.GetGlobal("_expand_last")) {
+		for i, arg := range args {
+			args[i] = strings.Replace(arg, "$_", lastOutput, -1)
+		}
+	}
+
+	args, err := expandGlobs(L, cmd, args)
+	if err != nil {
+		fmt.Println(err.Error())
+		return nil, statusError
+	}
+	return &parsedLine{cmd: cmd, args: args}, statusOK
+}
+
+func parseCommand(L *lua.LState, line string) commandStatus {
+	// Shows how a line would be split up and run, without running it
+	if line == "" {
+		fmt.Println("Usage: parse COMMAND [ARGS...]")
+		return statusUsage
+	}
+	parsed, status := parseLine(L, line)
+	if parsed == nil {
+		return status
+	}
+	return showParsed(L, parsed)
+}
+
+func showParsed(L *lua.LState, parsed *parsedLine) commandStatus {
+	printKeyValue(L, "command", parsed.cmd, 9)
+	for i, arg := range parsed.args {
+		printKeyValue(L, strconv.Itoa(i+1), strconv.Quote(arg), 9)
+	}
+	if parsed.opts != nil {
+		value, err := luaToGo(parsed.opts)
+		opts, _ := json.Marshal(value)
+		if err != nil {
+			opts = []byte(err.Error())
+		}
+		printKeyValue(L, "options", string(opts), 9)
+	}
+	if len(parsed.pipeline) > 0 {
+		programs := []string{}
+		for _, stage := range parsed.pipeline {
+			programs = append(programs, shellJoin(stage))
+		}
+		printKeyValue(L, "pipe", strings.Join(programs, " | "), 9)
+	}
+	if parsed.redirect != "" {
+		redirect := "> "
+		if parsed.appending {
+			redirect = ">> "
+		}
+		printKeyValue(L, "output", redirect+parsed.redirect, 9)
+	}
+	return statusOK
+}
+
+// auditEvent is a line in the audit_file
+type auditEvent struct {
+	Time       string   `json:"time"`
+	SessionID  string   `json:"session_id"`
+	Command    string   `json:"command"`
+	Args       []string `json:"args"`
+	Redacted   bool     `json:"redacted,omitempty"`
+	DurationMs float64  `json:"duration_ms"`
+	Outcome    string   `json:"outcome"`
+}
+
+func writeAuditEvent(L *lua.LState, cmd string, args []string,
+	duration time.Duration, status commandStatus) {
+	// If audit_file is set, appends a JSON line to it describing the command
+	// that was run. Commands in the audit_redact list have their arguments
+	// left out. It's ignored with --sandbox, as it would let the file
+	// append to any file it likes.
+	filename, ok := L.GetGlobal("audit_file").(lua.LString)
+	if !ok || filename == "" || sandboxRequested() {
+		return
+	}
+	event := auditEvent{
+		Time:       time.Now().UTC().Format(time.RFC3339Nano),
+		SessionID:  L.GetGlobal("_session_id").String(),
+		Command:    cmd,
+		Args:       args,
+		DurationMs: float64(duration) / float64(time.Millisecond),
+		Outcome:    exitCodes[status].name,
+	}
+	if redact, ok := L.GetGlobal("audit_redact").(*lua.LTable); ok {
+		redact.ForEach(func(_, v lua.LValue) {
+			if v.String() == cmd {
+				event.Args = []string{}
+				event.Redacted = true
+			}
+		})
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		fmt.Println("Error writing audit event:", err)
+		return
+	}
+	f, err := os.OpenFile(string(filename),
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		fmt.Println("Error writing audit event:", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		fmt.Println("Error writing audit event:", err)
+	}
+}
+
+func expandEnv(line string, keepUnknown bool) string {
+	// Replaces environment variables in a line before it's split up,
+	// following the same quoting rules as shlex. Values are always quoted,
+	// so that they end up as part of the same argument and characters like
+	// > or ; in them don't turn into a redirect or another command when the
+	// line is split up afterwards. Unknown variables are left out, or left as they are
+	// with keepUnknown. $_ is left alone, as it's used for _expand_last.
+	var b strings.Builder
+	single, double := false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && !single && i+1 < len(line):
+			b.WriteByte(c)
+			b.WriteByte(line[i+1])
+			i++
+			continue
+		case c == '\'' && !double:
+			single = !single
+		case c == '"' && !single:
+			double = !double
+		case c == '$' && !single:
+			name, end := envVarName(line, i+1)
+			if name == "" || name == "_" {
+				break
+			}
+			value, ok := os.LookupEnv(name)
+			if !ok && keepUnknown {
+				value = line[i:end]
+			}
+			if double {
+				value = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value)
+			} else if value != "" {
+				value = "'" + strings.ReplaceAll(value, "'", `'"'"'`) + "'"
+			}
+			b.WriteString(value)
+			i = end - 1
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func envVarName(line string, start int) (string, int) {
+	// Returns the name of the variable after a $ (either NAME or {NAME}),
+	// and where it ends
+	if start < len(line) && line[start] == '{' {
+		end := strings.IndexByte(line[start:], '}')
+		if end < 0 {
+			return "", start
+		}
+		return line[start+1 : start+end], start + end + 1
+	}
+	end := start
+	for end < len(line) {
+		c := line[end]
+		if c != '_' && !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') &&
+			!(end > start && c >= '0' && c <= '9') {
+			break
+		}
+		end++
+	}
+	return line[start:end], end
+}
+
+func splitOptions(L *lua.LState, line string) (string, *lua.LTable) {
+	// A line can end with a lua table, e.g. deploy app {replicas=3}, to give
+	// the command some options. The table is evaluated with no globals
+	// available, so it can only contain plain values. Anything that isn't a
+	// table is left on the line as normal arguments.
+	if !strings.HasSuffix(line, "}") {
+		return line, nil
+	}
+	depth := 0
+	start := -1
+	for i := len(line) - 1; i >= 0; i-- {
+		if line[i] == '}' {
+			depth++
+		} else if line[i] == '{' {
+			depth--
+		}
+		if depth == 0 {
+			start = i
+			break
+		}
+	}
+	if start <= 0 || !strings.ContainsRune(" \t", rune(line[start-1])) {
+		return line, nil
+	}
+	fn, err := L.LoadString("return " + line[start:])
+	if err != nil {
+		return line, nil
+	}
+	fn.Env = L.NewTable()
+	if err := L.CallByParam(lua.P{
+		Fn:      fn,
+		NRet:    1,
+		Protect: true,
+	}); err != nil {
+		return line, nil
+	}
+	opts, ok := L.Get(-1).(*lua.LTable)
+	L.Pop(1)
+	if !ok {
+		return line, nil
+	}
+	return strings.TrimSpace(line[:start]), opts
+}
+
+func unquoted(line string, chars string) []int {
+	// Returns where any of chars are in a line, leaving out any inside
+	// quotes or an options table, or after the start of a comment. A { that
+	// is never closed isn't the start of a table, so it's scanned again
+	// without it.
+	literal := map[int]bool{}
+	for {
+		found, open := scanUnquoted(line, chars, literal)
+		if open < 0 {
+			return found
+		}
+		literal[open] = true
+	}
+}
+
+func scanUnquoted(line string, chars string, literal map[int]bool) ([]int, int) {
+	// Does the work for unquoted, also returning where the outermost { that
+	// is still open at the end of the line is (or -1 if there isn't one).
+	// Braces at the positions in literal aren't counted.
+	found := []int{}
+	single, double := false, false
+	braces, open := 0, -1
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && !single:
+			i++
+		case c == '\'' && !double:
+			single = !single
+		case c == '"' && !single:
+			double = !double
+		case single || double:
+			// Nothing else is special inside quotes
+		case c == '{' && !literal[i]:
+			if braces == 0 {
+				open = i
+			}
+			braces++
+		case c == '}' && braces > 0:
+			braces--
+		case braces > 0:
+			// Or inside lua tables
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return found, -1
+		case strings.IndexByte(chars, c) != -1:
+			found = append(found, i)
+		}
+	}
+	if braces == 0 {
+		open = -1
+	}
+	return found, open
+}
+
+func splitRedirect(line string) (string, string, bool) {
+	// Takes a > file or >> file off the end of a command, returning the rest
+	// of the command, the file, and whether to append to it. The > has to
+	// be unquoted and at the start of a word, and the file has to be the
+	// last word.
+	found := unquoted(line, ">")
+	for i := len(found) - 1; i >= 0; i-- {
+		start := found[i]
+		if start > 0 && line[start-1] != ' ' && line[start-1] != '\t' {
+			continue
+		}
+		if i > 0 && found[i-1] == start-1 {
+			// The second > of a >>
+			continue
+		}
+		appending := start+1 < len(line) && line[start+1] == '>'
+		rest := line[start+1:]
+		if appending {
+			rest = line[start+2:]
+		}
+		words, err := shlex.Split(rest)
+		if err != nil || len(words) != 1 {
+			return line, "", false
+		}
+		return strings.TrimRight(line[:start], " \t"), words[0], appending
+	}
+	return line, "", false
+}
+
+func splitPipeline(line string) (string, []string) {
+	// Splits a command at each unquoted | that's a word on its own,
+	// returning the command and the programs its output is piped through
+	stages := []string{}
+	end := len(line)
+	found := unquoted(line, "|")
+	for i := len(found) - 1; i >= 0; i-- {
+		pos := found[i]
+		if (pos > 0 && line[pos-1] != ' ' && line[pos-1] != '\t') ||
+			(pos+1 < len(line) && line[pos+1] != ' ' && line[pos+1] != '\t') {
+			continue
+		}
+		stages = append([]string{line[pos+1 : end]}, stages...)
+		end = pos
+	}
+	return strings.TrimRight(line[:end], " \t"), stages
+}
+
+func pipeOutput(pipeline [][]string, out io.Writer, run func()) error {
+	// Starts the programs in a pipeline, then runs a command with its
+	// output going into the first one. The command isn't run if any of the
+	// programs can't be started. Returns the error from the last program,
+	// if it fails.
+	cmds := make([]*exec.Cmd, len(pipeline))
+	for i, stage := range pipeline {
+		cmds[i] = exec.Command(stage[0], stage[1:]...)
+		cmds[i].Stderr = os.Stderr
+		if i > 0 {
+			stdout, err := cmds[i-1].StdoutPipe()
+			if err != nil {
+				return err
+			}
+			cmds[i].Stdin = stdout
+		}
+	}
+	cmds[len(cmds)-1].Stdout = out
+	stdin, err := cmds[0].StdinPipe()
+	if err != nil {
+		return err
+	}
+	for i, c := range cmds {
+		if err := c.Start(); err != nil {
+			stdin.Close()
+			for _, started := range cmds[:i] {
+				started.Process.Kill()
+				started.Wait()
+			}
+			return err
+		}
+	}
+	captureOutput(stdin, run)
+	stdin.Close()
+	for _, c := range cmds {
+		err = c.Wait()
+	}
+	if _, ok := err.(*exec.ExitError); ok {
+		// Programs like grep exit with an error when nothing matched, which
+		// isn't worth reporting
+		return nil
+	}
+	return err
+}
+
+func splitCommand(L *lua.LState, parts []string) (string, []string) {
+	// Splits a line into the command and its arguments. Command names can
+	// have spaces in them (e.g. do_show version), so the longest name that
+	// matches the first words is used.
+	for n := len(parts); n > 1; n-- {
+		name := strings.Join(parts[:n], " ")
+		if _, ok := L.GetGlobal("do_" + name).(*lua.LFunction); ok {
+			return name, parts[n:]
+		}
+	}
+	return parts[0], parts[1:]
+}
+
+func matchPrefix(L *lua.LState, cmd string) (string, []string) {
+	// Lets a command be run by typing the start of its name, as long as no
+	// other command starts the same way. An exact match always wins. Returns
+	// the command to run, and the candidates if there's more than one. Set
+	// _prefix_matching to false to turn this off.
+	if v := L.GetGlobal("_prefix_matching"); v != lua.LNil && !lua.LVAsBool(v) {
+		return cmd, nil
+	}
+	if _, ok := L.GetGlobal("do_" + cmd).(*lua.LFunction); ok ||
+		cmd == "help" || isBuiltin(cmd) {
+		return cmd, nil
+	}
+	matches := []string{}
+	for _, name := range commandNames(L) {
+		if strings.HasPrefix(name, cmd) && commandAllowed(L, name) &&
+			!isHidden(L, name) {
+			matches = append(matches, name)
+		}
+	}
+	if len(matches) == 1 {
+		return matches[0], nil
+	}
+	return cmd, matches
+}
+
+func expandGlobs(L *lua.LState, cmd string, args []string) ([]string, error) {
+	// If a command has a glob_<cmd> function, any arguments with wildcards
+	// are replaced with the list of names it returns for them. As in the
+	// shell, a pattern that doesn't match anything is left as it is.
+	globfn, ok := L.GetGlobal("glob_" + cmd).(*lua.LFunction)
+	if !ok {
+		return args, nil
+	}
+	expanded := []string{}
+	for _, arg := range args {
+		if !strings.ContainsAny(arg, "*?[") {
+			expanded = append(expanded, arg)
+			continue
+		}
+		if err := L.CallByParam(lua.P{
+			Fn:      globfn,
+			NRet:    1,
+			Protect: true,
+		}, lua.LString(arg)); err != nil {
+			return nil, err
+		}
+		matches, ok := L.Get(-1).(*lua.LTable)
+		L.Pop(1)
+		if !ok || matches.Len() == 0 {
+			expanded = append(expanded, arg)
+			continue
+		}
+		matches.ForEach(func(_, v lua.LValue) {
+			expanded = append(expanded, v.String())
+		})
+	}
+	return expanded, nil
+}
+
+func runCommand(L *lua.LState, cmd string, args []string,
+	opts *lua.LTable) commandStatus {
+	if !commandAllowed(L, cmd) {
+		fmt.Println("Permission denied:", cmd)
+		return statusDenied
+	}
+
+	// Help for commands is implemented in the help_foo
+	if cmd == "help" {
+		if len(args) == 0 || args[0] == "--all" || args[0] == "-a" {
+			printCommands(L, len(args) > 0)
+			return statusOK
+		} else {
+			name, _ := splitCommand(L, args)
+			help, ok := commandHelp(L, name)
+			if !ok {
+				fmt.Println("No help for command:", name)
+				return statusError
+			}
+			fmt.Println(help)
+			return statusOK
+		}
+	}
+
+	fn, ok := L.GetGlobal("do_" + cmd).(*lua.LFunction)
+	if !ok {
+		if status, ok := runBuiltin(L, cmd, args); ok {
+			return status
+		}
+		fmt.Println("Unknown command:", cmd)
+		return statusUnknown
+	}
+
+	// Convert args into a lua table
+	argsTable, err := argsToTable(L, cmd, args)
+	if err != nil {
+		fmt.Println(err.Error())
+		return statusUsage
+	}
+
+	callArgs := []lua.LValue{argsTable}
+	if wantsTempfile(L, cmd) {
+		// Commands listed in wants_tempfile (or stdin_tempfile) get the name
+		// of a temporary file as their second parameter, which is removed
+		// once they finish. Other commands don't get one made at all.
+		tmpfile, err := newTempFile()
+		if err != nil {
+			fmt.Println(err)
+			return statusError
+		}
+		tmpfilename := tmpfile.Name()
+		// Commands listed in stdin_tempfile get piped input in the file
+		if wantsStdin, ok := L.GetGlobal("stdin_tempfile").(*lua.LTable); ok &&
+			lua.LVAsBool(L.GetField(wantsStdin, cmd)) && stdinAvailable() {
+			if _, err := io.Copy(tmpfile, os.Stdin); err != nil {
+				fmt.Println("Error reading stdin:", err)
+				tmpfile.Close()
+				removeTempFile(tmpfilename)
+				return statusError
+			}
+		}
+		// We don't use the file directly, so close it
+		tmpfile.Close()
+		defer removeTempFile(tmpfilename)
+		callArgs = append(callArgs, lua.LString(tmpfilename))
+	}
+
+	// Options from a table at the end of the line are the third parameter,
+	// after the temporary file
+	if opts != nil || fn.Proto.NumParameters >= 3 {
+		if len(callArgs) == 1 {
+			callArgs = append(callArgs, lua.LNil)
+		}
+		if opts == nil {
+			opts = L.NewTable()
+		}
+		callArgs = append(callArgs, opts)
+	}
+
+	result, err := callCommand(L, fn, callArgs...)
+	if err != nil {
+		return printError(L, err)
+	}
+	// Returning "exit" from a command ends the session, like ^D
+	if result == lua.LString("exit") {
+		exitRequested = true
+		return statusOK
+	}
+	return printResult(L, cmd, result)
+}
+
+func wantsTempfile(L *lua.LState, cmd string) bool {
+	for _, name := range []string{"wants_tempfile", "stdin_tempfile"} {
+		if tbl, ok := L.GetGlobal(name).(*lua.LTable); ok &&
+			lua.LVAsBool(L.GetField(tbl, cmd)) {
+			return true
+		}
+	}
+	return false
+}
+
+// tempFiles are the temporary files that haven't been removed yet, so they
+// can be cleaned up if the cli is killed while a command is running
+var tempFiles = map[string]bool{}
+var tempFilesLock sync.Mutex
+
+func newTempFile() (*os.File, error) {
+	f, err := ioutil.TempFile("", "simplecli")
+	if err == nil {
+		tempFilesLock.Lock()
+		tempFiles[f.Name()] = true
+		tempFilesLock.Unlock()
+	}
+	return f, err
+}
+
+func removeTempFile(name string) {
+	tempFilesLock.Lock()
+	defer tempFilesLock.Unlock()
+	os.Remove(name)
+	delete(tempFiles, name)
+}
+
+func removeTempFiles() {
+	tempFilesLock.Lock()
+	defer tempFilesLock.Unlock()
+	for name := range tempFiles {
+		os.Remove(name)
+	}
+	tempFiles = map[string]bool{}
+}
+
+func cleanupOnSignal() {
+	// Removes the temporary files before exiting on SIGTERM, or on ^C when
+	// there's nothing running for it to stop instead
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			if sig == os.Interrupt && atomic.LoadInt32(&interruptHandlers) > 0 {
+				continue
+			}
+			removeTempFiles()
+			os.Exit(128 + int(sig.(syscall.Signal)))
+		}
+	}()
+}
+
+func printResult(L *lua.LState, cmd string, result lua.LValue) commandStatus {
+	// Shows the value returned by a command, if any. With --json it's
+	// printed as JSON, otherwise format_<cmd> can turn it into the text to
+	// show. Without a formatter, tables are shown as JSON too.
+	if result == lua.LNil {
+		return statusOK
+	}
+	formatfn, ok := L.GetGlobal("format_" + cmd).(*lua.LFunction)
+	if ok && !*jsonOutput {
+		text, err := callFunction(L, formatfn, result)
+		if err != nil {
+			return printError(L, err)
+		}
+		if text != lua.LNil {
+			fmt.Println(text.String())
+		}
+		return statusOK
+	}
+	if _, isTable := result.(*lua.LTable); !isTable && !*jsonOutput {
+		fmt.Println(result.String())
+		return statusOK
+	}
+	value, err := luaToGo(result)
+	if err != nil {
+		fmt.Println("Error converting result to JSON:", err)
+		return statusError
+	}
+	out, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		fmt.Println("Error converting result to JSON:", err)
+		return statusError
+	}
+	fmt.Println(string(out))
+	return statusOK
+}
+
+func luaToGo(v lua.LValue) (interface{}, error) {
+	// Converts a lua value into plain go values that can be written as
+	// JSON. Tables with only the keys 1..n become lists, other tables become
+	// objects, and functions and the like become their string form. Tables
+	// that contain themselves can't be converted.
+	return luaToGoValue(v, map[*lua.LTable]bool{})
+}
+
+func luaToGoValue(v lua.LValue, seen map[*lua.LTable]bool) (interface{}, error) {
+	switch v := v.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		return float64(v), nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LTable:
+		if seen[v] {
+			return nil, errors.New("can't convert a table that contains itself")
+		}
+		seen[v] = true
+		defer delete(seen, v)
+		count := 0
+		v.ForEach(func(_, _ lua.LValue) { count++ })
+		if n := v.MaxN(); n > 0 && n == count {
+			list := make([]interface{}, n)
+			for i := range list {
+				value, err := luaToGoValue(v.RawGetInt(i+1), seen)
+				if err != nil {
+					return nil, err
+				}
+				list[i] = value
+			}
+			return list, nil
+		}
+		obj := map[string]interface{}{}
+		var err error
+		v.ForEach(func(k, val lua.LValue) {
+			if err == nil {
+				obj[k.String()], err = luaToGoValue(val, seen)
+			}
+		})
+		return obj, err
+	default:
+		return v.String(), nil
+	}
+}
+
+func goToLua(L *lua.LState, v interface{}) lua.LValue {
+	// Converts values decoded from JSON into lua values, with lists becoming
+	// tables with the keys 1..n
+	switch v := v.(type) {
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		t := L.NewTable()
+		for i, item := range v {
+			t.RawSetInt(i+1, goToLua(L, item))
+		}
+		return t
+	case map[string]interface{}:
+		t := L.NewTable()
+		for k, item := range v {
+			t.RawSetString(k, goToLua(L, item))
+		}
+		return t
+	}
+	return lua.LNil
+}
+
+func cliJSON(L *lua.LState) int {
+	// cli_json("encode", value) returns value as JSON, and
+	// cli_json("decode", text) turns JSON into lua values. Both return nil
+	// and an error message on failure.
+	var result lua.LValue
+	var err error
+	switch action := L.CheckString(1); action {
+	case "encode":
+		var value interface{}
+		if value, err = luaToGo(L.CheckAny(2)); err == nil {
+			var out []byte
+			out, err = json.Marshal(value)
+			result = lua.LString(out)
+		}
+	case "decode":
+		var value interface{}
+		err = json.Unmarshal([]byte(L.CheckString(2)), &value)
+		result = goToLua(L, value)
+	default:
+		L.ArgError(1, "unknown action: "+action)
+	}
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(result)
+	return 1
+}
+
+// lastError is the most recent error from a command, kept for the error
+// command and cli_last_error until a command succeeds
+var lastError struct {
+	message   string
+	traceback string
+}
+
+func printError(L *lua.LState, err error) commandStatus {
+	// Prints an error from running lua code and returns the status for it.
+	// Only the message is shown unless _debug is set, but the stack trace is
+	// kept for the error built in. Failed assertions go to stderr without a
+	// stack trace.
+	lastError.message, lastError.traceback = err.Error(), ""
+	var apiErr *lua.ApiError
+	if errors.As(err, &apiErr) {
+		lastError.message = apiErr.Object.String()
+		lastError.traceback = apiErr.StackTrace
+	}
+	if msg, ok := assertionMessage(err); ok {
+		lastError.message = msg
+		fmt.Fprintln(os.Stderr, "Assertion failed:", msg)
+		return statusAssert
+	}
+	if lua.LVAsBool(L.GetGlobal("_debug")) {
+		fmt.Println(colorize(L, "error", err.Error()))
+	} else {
+		fmt.Println(colorize(L, "error", lastError.message))
+	}
+	return statusError
+}
+
+func printLastError(L *lua.LState) {
+	if lastError.message == "" {
+		fmt.Println("No errors")
+		return
+	}
+	fmt.Println(colorize(L, "error", lastError.message))
+	if lastError.traceback != "" {
+		fmt.Println(lastError.traceback)
+	}
+}
+
+func cliHistory(L *lua.LState) int {
+	// cli_history("list") returns the history as a table, cli_history("clear")
+	// clears it (including the history file) and cli_history("add", line)
+	// adds a line to it
+	switch action := L.CheckString(1); action {
+	case "list":
+		t := L.NewTable()
+		for _, line := range historyLines {
+			t.Append(lua.LString(line))
+		}
+		L.Push(t)
+		return 1
+	case "clear":
+		historyLines = nil
+		if lineReader != nil {
+			lineReader.ResetHistory()
+		}
+		if historyPath != "" {
+			if err := os.Truncate(historyPath, 0); err != nil {
+				L.RaiseError("can't clear history file: %s", err)
+			}
+		}
+	case "add":
+		line := L.CheckString(2)
+		addHistoryLine(line)
+		if lineReader != nil {
+			if err := lineReader.SaveHistory(line); err != nil {
+				L.RaiseError("can't save history: %s", err)
+			}
+		}
+	default:
+		L.ArgError(1, "unknown action: "+action)
+	}
+	return 0
+}
+
+func cliLastError(L *lua.LState) int {
+	// Returns the last error message and its traceback, or nil if the last
+	// command succeeded
+	if lastError.message == "" {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(lua.LString(lastError.message))
+	L.Push(lua.LString(lastError.traceback))
+	return 2
+}
+
+// terminalStdout is the original stdout, for things like editors that need
+// to talk to the terminal even while command output is being captured
+var terminalStdout = os.Stdout
+
+// teeFile is the file that command output is copied to when cli_tee is on
+var teeFile *os.File
+
+// lastOutput is the output of the previous command, used for $_ when
+// _expand_last is set
+var lastOutput = ""
+
+func commandOutput(L *lua.LState) (io.Writer, func()) {
+	// Returns where the output for a command typed at the prompt needs to
+	// go, or nil if it should just go to the terminal as normal. The
+	// returned function must be called once the command has finished.
+	if commandDepth > 1 {
+		// Commands run by other commands are part of the outer command's
+		// output
+		return nil, nil
+	}
+	writers := []io.Writer{os.Stdout}
+	finished := []func(){}
+	// With page_output set, output that doesn't fit on the screen is shown a
+	// page at a time once the command has finished
+	if lua.LVAsBool(L.GetGlobal("page_output")) &&
+		term.IsTerminal(int(os.Stdout.Fd())) {
+		buf := &bytes.Buffer{}
+		writers[0] = buf
+		finished = append(finished, func() {
+			pageOutput(buf.String())
+		})
+	}
+	// With highlight_output set, text matching the patterns in the
+	// highlight table is colored
+	if lua.LVAsBool(L.GetGlobal("highlight_output")) && useColor(L) {
+		if h := newHighlighter(L, writers[0]); h != nil {
+			writers[0] = h
+			finished = append([]func(){h.flush}, finished...)
+		}
+	}
+	if teeFile != nil {
+		writers = append(writers, teeFile)
+	}
+	if recordOutput != nil {
+		writers = append(writers, recordOutput)
+	}
+	if lua.LVAsBool(L.GetGlobal("_expand_last")) {
+		buf := &bytes.Buffer{}
+		writers = append(writers, buf)
+		finished = append(finished, func() {
+			lastOutput = strings.TrimRight(buf.String(), "\n")
+		})
+	}
+	if len(writers) == 1 && len(finished) == 0 {
+		return nil, nil
+	}
+	return io.MultiWriter(writers...), func() {
+		for _, f := range finished {
+			f()
+		}
+	}
+}
+
+// highlighter colors the parts of each line of output that match the
+// patterns in the highlight table
+type highlighter struct {
+	out      io.Writer
+	patterns []*regexp.Regexp
+	colors   []string
+	partial  []byte
+}
+
+func newHighlighter(L *lua.LState, out io.Writer) *highlighter {
+	// Returns nil if there aren't any patterns to highlight
+	tbl, ok := L.GetGlobal("highlight").(*lua.LTable)
+	if !ok {
+		return nil
+	}
+	h := &highlighter{out: out}
+	patterns := []string{}
+	colorNames := map[string]string{}
+	tbl.ForEach(func(k, v lua.LValue) {
+		patterns = append(patterns, k.String())
+		colorNames[k.String()] = v.String()
+	})
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			fmt.Printf("Bad highlight pattern %q: %s\n", pattern, err)
+			continue
+		}
+		code, ok := colors[themeColor(L, colorNames[pattern])]
+		if !ok {
+			code, ok = colors[colorNames[pattern]]
+		}
+		if !ok {
+			fmt.Println("Unknown highlight color:", colorNames[pattern])
+			continue
+		}
+		h.patterns = append(h.patterns, re)
+		h.colors = append(h.colors, code)
+	}
+	if len(h.patterns) == 0 {
+		return nil
+	}
+	return h
+}
+
+func (h *highlighter) Write(p []byte) (int, error) {
+	// Output is colored a line at a time, so anything after the last
+	// newline is kept until the rest of the line is written
+	h.partial = append(h.partial, p...)
+	end := bytes.LastIndexByte(h.partial, '\n')
+	if end < 0 {
+		return len(p), nil
+	}
+	for _, line := range strings.SplitAfter(string(h.partial[:end+1]), "\n") {
+		if _, err := io.WriteString(h.out, h.highlight(line)); err != nil {
+			return 0, err
+		}
+	}
+	h.partial = append([]byte{}, h.partial[end+1:]...)
+	return len(p), nil
+}
+
+func (h *highlighter) flush() {
+	io.WriteString(h.out, h.highlight(string(h.partial)))
+	h.partial = nil
+}
+
+func (h *highlighter) highlight(line string) string {
+	// Colors the matches in a line. Where matches overlap, the one that
+	// starts first wins.
+	type match struct {
+		start, end int
+		color      string
+	}
+	matches := []match{}
+	for i, re := range h.patterns {
+		for _, m := range re.FindAllStringIndex(line, -1) {
+			if m[1] > m[0] {
+				matches = append(matches, match{m[0], m[1], h.colors[i]})
+			}
+		}
+	}
+	if len(matches) == 0 {
+		return line
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].start < matches[j].start
+	})
+	var b strings.Builder
+	pos := 0
+	for _, m := range matches {
+		if m.start < pos {
+			continue
+		}
+		b.WriteString(line[pos:m.start])
+		b.WriteString("\033[" + m.color + "m" + line[m.start:m.end] + "\033[0m")
+		pos = m.end
+	}
+	b.WriteString(line[pos:])
+	return b.String()
+}
+
+func pageOutput(text string) {
+	// Shows command output that's too long for the screen with $PAGER, or
+	// with a simple built in pager if that isn't set
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	_, height := terminalSize()
+	pageSize := height - 1
+	if len(lines) <= pageSize || pageSize < 1 {
+		fmt.Print(text)
+		return
+	}
+	if pager := os.Getenv("PAGER"); pager != "" {
+		c := exec.Command("sh", "-c", pager)
+		c.Stdin = strings.NewReader(text)
+		if err := runInteractive(c); err != nil {
+			fmt.Println("Error running pager:", err)
+			fmt.Print(text)
+		}
+		return
+	}
+
+	// The built in pager reads a line at a time with readline, as readline
+	// is already reading from the terminal. Enter shows the next page,
+	// b goes back, /text searches, n finds the next match and q quits.
+	top := 0
+	search := ""
+	for {
+		end := top + pageSize
+		if end > len(lines) {
+			end = len(lines)
+		}
+		for _, line := range lines[top:end] {
+			fmt.Println(line)
+		}
+		if end == len(lines) {
+			return
+		}
+		answer, ok := promptLine(fmt.Sprintf("--More-- (%d%%) ",
+			end*100/len(lines)), "")
+		if !ok {
+			return
+		}
+		switch answer = strings.TrimSpace(answer); {
+		case answer == "q":
+			return
+		case answer == "b":
+			top -= pageSize
+			if top < 0 {
+				top = 0
+			}
+		case strings.HasPrefix(answer, "/") || answer == "n":
+			if answer != "n" {
+				search = answer[1:]
+			}
+			found := false
+			for i := top + 1; search != "" && i < len(lines); i++ {
+				if strings.Contains(lines[i], search) {
+					top = i
+					found = true
+					break
+				}
+			}
+			if !found {
+				fmt.Println("Pattern not found")
+				top = end - pageSize
+			}
+		default:
+			top = end
+		}
+	}
+}
+
+func captureOutput(w io.Writer, fn func()) {
+	// Runs fn with stdout going to w. This catches anything written with
+	// print, io.write or from go, and the output of commands run with
+	// os.execute.
+	r, pw, err := os.Pipe()
+	if err != nil {
+		fmt.Println("Error capturing output:", err)
+		fn()
+		return
+	}
+	stdout := os.Stdout
+	os.Stdout = pw
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(w, r)
+		r.Close()
+		close(copied)
+	}()
+	defer func() {
+		os.Stdout = stdout
+		pw.Close()
+		<-copied
+	}()
+	fn()
+}
+
+// commandContext is cancelled if ^C is pressed while a command is running,
+// so that helpers which wait for something can give up early
+var commandContext = context.Background()
+
+// interruptHandlers counts what's waiting for ^C to stop it (a command or
+// watch), so that ^C doesn't exit the cli while there is something
+var interruptHandlers int32
+
+func callCommand(L *lua.LState, fn *lua.LFunction, args ...lua.LValue) (lua.LValue, error) {
+	// Calls a command function and returns its result, stopping it if ^C is
+	// pressed. Commands run by other commands share the outer command's
+	// context.
+	if commandContext != context.Background() {
+		return callFunction(L, fn, args...)
+	}
+
+	atomic.AddInt32(&interruptHandlers, 1)
+	defer atomic.AddInt32(&interruptHandlers, -1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		for {
+			select {
+			case <-interrupt:
+				if atomic.LoadInt32(&childRunning) == 0 {
+					cancel()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	commandContext = ctx
+	L.SetContext(ctx)
+	defer func() {
+		L.RemoveContext()
+		commandContext = context.Background()
+	}()
+
+	result, err := callFunction(L, fn, args...)
+	if err != nil && ctx.Err() != nil {
+		return lua.LNil, errors.New("Interrupted")
+	}
+	return result, err
+}
+
+func callFunction(L *lua.LState, fn *lua.LFunction, args ...lua.LValue) (lua.LValue, error) {
+	if err := L.CallByParam(lua.P{
+		Fn:      fn,
+		NRet:    1,
+		Protect: true,
+	}, args...); err != nil {
+		return lua.LNil, err
+	}
+	result := L.Get(-1)
+	L.Pop(1)
+	return result, nil
+}
+
+func commandAllowed(L *lua.LState, cmd string) bool {
+	// With --allow or an allowed_commands list, only the commands listed
+	// can be run. Built in commands can always be run unless they're
+	// excluded with a !, e.g. --allow deploy,status,!watch. Piping output
+	// to programs and redirecting it to files are checked as the "|" and
+	// ">" commands, so they're only allowed if they're listed.
+	var allowed []string
+	if *allow != "" {
+		allowed = strings.Split(*allow, ",")
+	} else if tbl, ok := L.GetGlobal("allowed_commands").(*lua.LTable); ok {
+		tbl.ForEach(func(_, v lua.LValue) {
+			allowed = append(allowed, v.String())
+		})
+	} else {
+		return true
+	}
+	_, defined := L.GetGlobal("do_" + cmd).(*lua.LFunction)
+	builtin := cmd == "help" || (!defined && isBuiltin(cmd))
+	for _, name := range allowed {
+		name = strings.TrimSpace(name)
+		if name == "!"+cmd {
+			return false
+		}
+		if name == cmd {
+			return true
+		}
+	}
+	return builtin
+}
+
+// builtinCommands are the commands runBuiltin knows about
+var builtinCommands = []string{"keys", "dirs", "watch", "diffrun", "error",
+	"plugins", "config", "snapshot", "restore", "transcript", "reload",
+	"parse", "setup"}
+
+func isBuiltin(cmd string) bool {
+	for _, name := range builtinCommands {
+		if name == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+func runBuiltin(L *lua.LState, cmd string, args []string) (commandStatus, bool) {
+	// Runs one of the commands built in to simplecli, returning false if
+	// there isn't one by that name. Commands defined in lua take precedence
+	// over these.
+	switch cmd {
+	case "keys":
+		printKeyBindings()
+		return statusOK, true
+	case "dirs":
+		printDirStacks(L)
+		return statusOK, true
+	case "watch":
+		return watchCommand(L, args), true
+	case "diffrun":
+		return diffrunCommand(L, args), true
+	case "error":
+		printLastError(L)
+		return statusOK, true
+	case "plugins":
+		if len(args) > 0 && args[0] == "reload" {
+			return loadPlugins(L), true
+		}
+		printPlugins()
+		return statusOK, true
+	case "config":
+		printConfig(L)
+		return statusOK, true
+	case "transcript":
+		return transcriptCommand(args), true
+	case "snapshot":
+		return takeSnapshot(L, args), true
+	case "restore":
+		return restoreSnapshot(L, args), true
+	case "reload":
+		return reloadCli(L), true
+	case "setup":
+		return runSetup(L), true
+	case "parse":
+		// Normally dispatch runs this with the line as it was typed, but
+		// from dispatchArgs the words have been split up already
+		if len(args) == 0 {
+			return parseCommand(L, ""), true
+		}
+		parsed, status := parseArgs(L, args)
+		if parsed == nil {
+			return status, true
+		}
+		return showParsed(L, parsed), true
+	}
+	return statusOK, false
+}
+
+func watchCommand(L *lua.LState, args []string) commandStatus {
+	// Clears the screen and runs a command every interval seconds until ^C
+	// is pressed
+	if len(args) < 2 {
+		fmt.Println("Usage: watch INTERVAL COMMAND [ARGS...]")
+		return statusUsage
+	}
+	interval, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || interval <= 0 {
+		fmt.Println("Interval must be a number of seconds, got", args[0])
+		return statusUsage
+	}
+	line := shellJoin(args[1:])
+
+	atomic.AddInt32(&interruptHandlers, 1)
+	defer atomic.AddInt32(&interruptHandlers, -1)
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	for {
+		fmt.Print("\033[H\033[2J")
+		fmt.Println(colorize(L, "header", fmt.Sprintf("Every %gs: %s    %s",
+			interval, line, time.Now().Format("Mon Jan 2 15:04:05 2006"))))
+		fmt.Println()
+		dispatchArgs(L, args[1:])
+		select {
+		case <-time.After(secondsToDuration(interval)):
+		case <-interrupt:
+			return statusOK
+		}
+	}
+}
+
+func diffrunCommand(L *lua.LState, args []string) commandStatus {
+	// Runs a command twice and shows how the output changed, for checking
+	// that something has settled down
+	if len(args) == 0 {
+		fmt.Println("Usage: diffrun COMMAND [ARGS...]")
+		return statusUsage
+	}
+	outputs := [2]bytes.Buffer{}
+	for i := range outputs {
+		status := statusOK
+		captureOutput(&outputs[i], func() {
+			status = dispatchArgs(L, args)
+		})
+		if status != statusOK {
+			fmt.Print(outputs[i].String())
+			return status
+		}
+	}
+	before := strings.Split(strings.TrimRight(outputs[0].String(), "\n"), "\n")
+	after := strings.Split(strings.TrimRight(outputs[1].String(), "\n"), "\n")
+	diff := diffLines(before, after)
+	if diff == nil {
+		fmt.Println("No change")
+		return statusOK
+	}
+	for _, l := range diff {
+		fmt.Println(l)
+	}
+	return statusOK
+}
+
+func diffLines(a []string, b []string) []string {
+	// Returns a line by line diff of a and b, with lines only in a prefixed
+	// with "-", lines only in b with "+", and common lines with " ". Returns
+	// nil if they're the same.
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	diff := []string{}
+	changed := false
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			diff = append(diff, " "+a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "-"+a[i])
+			changed = true
+			i++
+		default:
+			diff = append(diff, "+"+b[j])
+			changed = true
+			j++
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return diff
+}
+
+// pluginGlobals are the globals each plugin file set when it was loaded, so
+// they can be removed before the plugins are loaded again
+var pluginGlobals = map[string][]string{}
+
+func globalsSnapshot(L *lua.LState) map[string]lua.LValue {
+	snapshot := map[string]lua.LValue{}
+	L.Get(lua.GlobalsIndex).(*lua.LTable).ForEach(func(k, v lua.LValue) {
+		snapshot[k.String()] = v
+	})
+	return snapshot
+}
+
+func loadPlugins(L *lua.LState) commandStatus {
+	// Loads (or reloads) every .lua file in plugin_dir, after removing
+	// anything the plugins defined last time
+	for _, names := range pluginGlobals {
+		for _, name := range names {
+			L.SetGlobal(name, lua.LNil)
+		}
+	}
+	pluginGlobals = map[string][]string{}
+	dir, ok := L.GetGlobal("plugin_dir").(lua.LString)
+	if !ok || dir == "" {
+		return statusOK
+	}
+	// Loading the plugins would let the file run any lua file it likes,
+	// which --sandbox removes dofile to stop
+	if sandboxRequested() {
+		fmt.Println("Warning: plugins aren't loaded with --sandbox")
+		return statusOK
+	}
+	files, err := filepath.Glob(filepath.Join(string(dir), "*.lua"))
+	if err != nil {
+		fmt.Println("Error finding plugins:", err)
+		return statusError
+	}
+	status := statusOK
+	for _, file := range files {
+		before := globalsSnapshot(L)
+		if err := L.DoFile(file); err != nil {
+			fmt.Println(err.Error())
+			status = statusError
+		}
+		names := []string{}
+		for name, v := range globalsSnapshot(L) {
+			if old, ok := before[name]; !ok || old != v {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		pluginGlobals[file] = names
+	}
+	return status
+}
+
+func printPlugins() {
+	files := []string{}
+	for file := range pluginGlobals {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		commands := []string{}
+		for _, name := range pluginGlobals[file] {
+			if strings.HasPrefix(name, "do_") {
+				commands = append(commands, name[3:])
+			}
+		}
+		fmt.Printf("%s: %s\n", file, strings.Join(commands, " "))
+	}
+}
+
+func reloadCli(L *lua.LState) commandStatus {
+	// Loads the lua file (and plugins) again, so changes take effect without
+	// restarting. Variables set from the command line or the environment,
+	// and ones changed while running, keep their values. If the file has an
+	// error, everything is left how it was.
+	kept := map[string]lua.LValue{}
+	for name, source := range configSources {
+		value := dottedValue(L, name)
+		if source == "flag" || source == "--set" ||
+			strings.HasPrefix(source, "$") || value != configValues[name] {
+			kept[name] = value
+		}
+	}
+	before := globalsSnapshot(L)
+	if err := L.DoFile(cliFile); err != nil {
+		fmt.Println(err.Error())
+		for name := range globalsSnapshot(L) {
+			if _, ok := before[name]; !ok {
+				L.SetGlobal(name, lua.LNil)
+			}
+		}
+		for name, v := range before {
+			L.SetGlobal(name, v)
+		}
+		fmt.Println("Reload failed, keeping the old configuration")
+		return statusError
+	}
+	registerLuaFunctions(L)
+	status := loadPlugins(L)
+	for name, value := range kept {
+		if err := setDottedValue(L, name, value); err != nil {
+			fmt.Println(err.Error())
+		}
+	}
+	for name := range configSources {
+		if _, ok := kept[name]; !ok {
+			configValues[name] = dottedValue(L, name)
+		}
+	}
+	fmt.Println("Reloaded", cliFile)
+	return status
+}
+
+// keyBinding is a key and a description of what it does
+type keyBinding struct {
+	key    string
+	action string
+}
+
+// keyBindings are the keys handled at the prompt, listed by the keys command
+var keyBindings = []keyBinding{
+	{"Tab", "Complete the command or argument"},
+	{"Enter", "Run the command"},
+	{"Ctrl-C", "Clear the line, exit if it's empty, or stop a running command"},
+	{"Ctrl-D", "Exit if the line is empty, otherwise delete a character"},
+	{"Ctrl-L", "Clear the screen"},
+	{"Ctrl-R", "Search history"},
+	{"Up/Ctrl-P", "Previous history entry"},
+	{"Down/Ctrl-N", "Next history entry"},
+	{"Ctrl-A", "Move to the start of the line"},
+	{"Ctrl-E", "Move to the end of the line"},
+	{"Ctrl-B/Ctrl-F", "Move back/forward a character"},
+	{"Alt-B/Alt-F", "Move back/forward a word"},
+	{"Ctrl-W", "Delete the previous word"},
+	{"Ctrl-K", "Delete to the end of the line"},
+	{"Ctrl-U", "Delete to the start of the line"},
+	{"Ctrl-T", "Swap the last two characters"},
+}
+
+func printKeyBindings() {
+	width := 0
+	for _, binding := range keyBindings {
+		if len(binding.key) > width {
+			width = len(binding.key)
+		}
+	}
+	for _, binding := range keyBindings {
+		fmt.Printf("%-*s  %s\n", width, binding.key, binding.action)
+	}
+}
+
+func argspec(L *lua.LState, cmd string) *lua.LTable {
+	// Returns the argspec_<cmd> table for a command, or nil if it doesn't
+	// declare one
+	spec, _ := L.GetGlobal("argspec_" + cmd).(*lua.LTable)
+	return spec
+}
+
+func argspecTable(L *lua.LState, spec *lua.LTable, field string) *lua.LTable {
+	if t, ok := L.GetField(spec, field).(*lua.LTable); ok {
+		return t
+	}
+	return &lua.LTable{}
+}
+
+func usageLine(L *lua.LState, cmd string) (string, bool) {
+	// Builds a usage line from a command's argspec, such as
+	// "Usage: scale NUMBER [BOOL]". Arguments after min are optional, and
+	// without a max any number of extra arguments are allowed.
+	spec := argspec(L, cmd)
+	if spec == nil {
+		return "", false
+	}
+	types := argspecTable(L, spec, "types")
+	min := numberField(L, spec, "min", 0)
+	max := numberField(L, spec, "max", -1)
+	count := types.Len()
+	if n := argspecTable(L, spec, "defaults").MaxN(); n > count {
+		count = n
+	}
+	if int(min) > count {
+		count = int(min)
+	}
+	if int(max) > count {
+		count = int(max)
+	}
+	usage := []string{"Usage:", cmd}
+	for i := 1; i <= count; i++ {
+		arg := "ARG"
+		if t := types.RawGetInt(i); t != lua.LNil {
+			arg = strings.ToUpper(t.String())
+		}
+		if float64(i) > min {
+			arg = "[" + arg + "]"
+		}
+		usage = append(usage, arg)
+	}
+	if max < 0 {
+		usage = append(usage, "[ARG...]")
+	}
+	return strings.Join(usage, " "), true
+}
+
+func argsToTable(L *lua.LState, cmd string, args []string) (*lua.LTable, error) {
+	// Converts command arguments into a lua table. If the command has an
+	// argspec_<cmd> table, the number of arguments is checked against its
+	// min and max, missing arguments are filled in from its defaults, and
+	// arguments are converted to its list of types (string, number or
+	// bool).
+	types := &lua.LTable{}
+	defaults := &lua.LTable{}
+	if spec := argspec(L, cmd); spec != nil {
+		types = argspecTable(L, spec, "types")
+		defaults = argspecTable(L, spec, "defaults")
+		usage, _ := usageLine(L, cmd)
+		if min := numberField(L, spec, "min", 0); float64(len(args)) < min {
+			return nil, fmt.Errorf("not enough arguments\n%s", usage)
+		}
+		max := numberField(L, spec, "max", -1)
+		if max >= 0 && float64(len(args)) > max {
+			return nil, fmt.Errorf("too many arguments\n%s", usage)
+		}
+	}
+	argsTable := &lua.LTable{}
+	for i, arg := range args {
+		argtype := "string"
+		if t := types.RawGetInt(i + 1); t != lua.LNil {
+			argtype = t.String()
+		}
+		switch argtype {
+		case "string":
+			argsTable.Append(lua.LString(arg))
+		case "number":
+			f, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				return nil, fmt.Errorf("expected number for argument %d, "+
+					"got %q", i+1, arg)
+			}
+			argsTable.Append(lua.LNumber(f))
+		case "bool":
+			b, ok := parseBool(arg)
+			if !ok {
+				return nil, fmt.Errorf("expected true or false for "+
+					"argument %d, got %q", i+1, arg)
+			}
+			argsTable.Append(lua.LBool(b))
+		default:
+			return nil, fmt.Errorf("unknown type %q for argument %d in "+
+				"argspec_%s", argtype, i+1, cmd)
+		}
+	}
+	for i := len(args) + 1; i <= defaults.MaxN(); i++ {
+		argsTable.RawSetInt(i, defaults.RawGetInt(i))
+	}
+	return argsTable, nil
+}
+
+func parseBool(value string) (bool, bool) {
+	// Like strconv.ParseBool, but also accepts yes/no and on/off
+	switch strings.ToLower(value) {
+	case "yes", "y", "on":
+		return true, true
+	case "no", "n", "off":
+		return false, true
+	}
+	b, err := strconv.ParseBool(value)
+	return b, err == nil
+}
+
+func evalLuaFile(L *lua.LState, filename string) int {
+	// Loads an extra lua file and calls its main function, returning the exit
+	// status. A main function can return a number to set the status itself,
+	// and errors use the "error" (or "assert") code from exit_codes.
+	if err := L.DoFile(filename); err != nil {
+		return exitCode(L, printError(L, err))
+	}
+	mainfn := L.GetGlobal("main")
+	if mainfn.Type() != lua.LTFunction {
+		return 0
+	}
+	if err := L.CallByParam(lua.P{
+		Fn:      mainfn,
+		NRet:    1,
+		Protect: true,
+	}); err != nil {
+		return exitCode(L, printError(L, err))
+	}
+	status := L.Get(-1)
+	L.Pop(1)
+	if n, ok := status.(lua.LNumber); ok {
+		return int(n)
+	}
+	return 0
+}
+
+func commandNames(L *lua.LState) []string {
+	// Returns the sorted names of all commands (do_ functions)
+	commands := []string{}
+	globals := L.Get(lua.GlobalsIndex).(*lua.LTable)
+	globals.ForEach(func(klv lua.LValue, v lua.LValue) {
+		k := klv.String()
+		if v.Type() == lua.LTFunction && strings.HasPrefix(k, "do_") {
+			commands = append(commands, k[3:])
+		}
+	})
+	sort.Strings(commands)
+	return commands
+}
+
+func commandHelp(L *lua.LState, cmd string) (string, bool) {
+	// Help for commands is in help_<cmd>, with leading whitespace stripped
+	// from each line, and blank lines at the start and end removed. Commands
+	// with an argspec get a usage line made from it after their help text.
+	helpText := L.GetGlobal("help_" + cmd)
+	usage, hasUsage := usageLine(L, cmd)
+	if helpText.Type() != lua.LTString {
+		return usage, hasUsage
+	}
+	helpLines := strings.Split(strings.TrimSpace(helpText.String()), "\n")
+	for i, line := range helpLines {
+		helpLines[i] = strings.TrimSpace(line)
+	}
+	if hasUsage {
+		helpLines = append(helpLines, "", usage)
+	}
+	return strings.Join(helpLines, "\n"), true
+}
+
+func isHidden(L *lua.LState, cmd string) bool {
+	// Commands listed in the hidden table still work, but are left out of
+	// the command list unless it's asked for with help --all
+	if hidden, ok := L.GetGlobal("hidden").(*lua.LTable); ok {
+		return lua.LVAsBool(L.GetField(hidden, cmd))
+	}
+	return false
+}
+
+// commandInfo describes a command for the command list and cli_commands
+type commandInfo struct {
+	name     string
+	category string
+	summary  string
+	hidden   bool
+}
+
+func commandList(L *lua.LState) []commandInfo {
+	// Returns all commands that are allowed to be run, sorted by name. The
+	// category comes from the categories table, and the summary is the first
+	// line of the help text.
+	categories, _ := L.GetGlobal("categories").(*lua.LTable)
+	commands := []commandInfo{}
+	for _, name := range commandNames(L) {
+		if !commandAllowed(L, name) {
+			continue
+		}
+		info := commandInfo{name: name, hidden: isHidden(L, name)}
+		if categories != nil {
+			if c, ok := L.GetField(categories, name).(lua.LString); ok {
+				info.category = string(c)
+			}
+		}
+		if help, ok := commandHelp(L, name); ok {
+			info.summary = strings.SplitN(help, "\n", 2)[0]
+		}
+		commands = append(commands, info)
+	}
+	return commands
+}
+
+func printCommands(L *lua.LState, all bool) {
+	fmt.Println(colorize(L, "header", "Available commands:"))
+	hidden := []string{}
+	for _, c := range commandList(L) {
+		if c.hidden {
+			hidden = append(hidden, c.name)
+			continue
+		}
+		fmt.Println(c.name)
+	}
+	if all && len(hidden) > 0 {
+		fmt.Println("\n" + colorize(L, "header", "Hidden commands:"))
+		for _, v := range hidden {
+			fmt.Println(v)
+		}
+	}
+}
+
+func cliCommands(L *lua.LState) int {
+	// Returns a list of tables describing each command, for rendering the
+	// command list some other way
+	result := L.NewTable()
+	for _, c := range commandList(L) {
+		info := L.NewTable()
+		L.SetField(info, "name", lua.LString(c.name))
+		if c.category != "" {
+			L.SetField(info, "category", lua.LString(c.category))
+		}
+		if c.summary != "" {
+			L.SetField(info, "summary", lua.LString(c.summary))
+		}
+		L.SetField(info, "hidden", lua.LBool(c.hidden))
+		result.Append(info)
+	}
+	L.Push(result)
+	return 1
+}
+
+func genDocsFile(L *lua.LState, format string, luaFile string, filename string) int {
+	// Writes the docs for --gen-docs to a file (or stdout if no filename was
+	// given), returning the exit status
+	name := strings.TrimSuffix(filepath.Base(luaFile), filepath.Ext(luaFile))
+	w := io.Writer(os.Stdout)
+	if filename != "" {
+		f, err := os.Create(filename)
+		if err != nil {
+			fmt.Println("Error creating docs file:", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := writeDocs(L, format, name, w); err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	return 0
+}
+
+// docSection is a group of commands in the generated docs
+type docSection struct {
+	category string
+	commands []string
+}
+
+func docSections(L *lua.LState) []docSection {
+	// Groups the commands that aren't hidden by their category in the
+	// categories table. Commands without a category come first (in a
+	// section with no category, which is always there), then each category
+	// in alphabetical order.
+	categories, _ := L.GetGlobal("categories").(*lua.LTable)
+	uncategorized := []string{}
+	grouped := map[string][]string{}
+	for _, cmd := range commandNames(L) {
+		if isHidden(L, cmd) {
+			continue
+		}
+		category := ""
+		if categories != nil {
+			if c, ok := L.GetField(categories, cmd).(lua.LString); ok {
+				category = string(c)
+			}
+		}
+		if category == "" {
+			uncategorized = append(uncategorized, cmd)
+		} else {
+			grouped[category] = append(grouped[category], cmd)
+		}
+	}
+	names := []string{}
+	for name := range grouped {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sections := []docSection{{commands: uncategorized}}
+	for _, name := range names {
+		sections = append(sections, docSection{name, grouped[name]})
+	}
+	return sections
+}
+
+func writeDocs(L *lua.LState, format string, name string, w io.Writer) error {
+	// Writes reference documentation for all commands, made from their help
+	// text, as markdown or a man page. Commands in the categories table are
+	// grouped under a heading for their category.
+	switch format {
+	case "markdown":
+		fmt.Fprintf(w, "# %s\n", name)
+		for _, section := range docSections(L) {
+			title := section.category
+			if title == "" {
+				title = "Commands"
+			}
+			fmt.Fprintf(w, "\n## %s\n", title)
+			for _, cmd := range section.commands {
+				help, ok := commandHelp(L, cmd)
+				if !ok {
+					help = "No help available."
+				}
+				fmt.Fprintf(w, "\n### %s\n\n```\n%s\n```\n", cmd, help)
+			}
+		}
+	case "man":
+		escape := strings.NewReplacer("\\", "\\e", "-", "\\-")
+		fmt.Fprintf(w, ".TH %s 1\n.SH NAME\n%s\n",
+			strings.ToUpper(escape.Replace(name)), escape.Replace(name))
+		for _, section := range docSections(L) {
+			title := section.category
+			if title == "" {
+				title = "Commands"
+			}
+			fmt.Fprintf(w, ".SH %s\n", strings.ToUpper(escape.Replace(title)))
+			for _, cmd := range section.commands {
+				help, ok := commandHelp(L, cmd)
+				if !ok {
+					help = "No help available."
+				}
+				fmt.Fprintf(w, ".TP\n.B %s\n.nf\n", escape.Replace(cmd))
+				for _, line := range strings.Split(help, "\n") {
+					line = escape.Replace(line)
+					// Lines starting with a dot would be taken as macros
+					if strings.HasPrefix(line, ".") || strings.HasPrefix(line, "'") {
+						line = "\\&" + line
+					}
+					fmt.Fprintln(w, line)
+				}
+				fmt.Fprintln(w, ".fi")
+			}
+		}
+	default:
+		return fmt.Errorf("unknown documentation format %q, "+
+			"expected markdown or man", format)
+	}
+	return nil
+}
+
+func parseCommandLineFlags(L *lua.LState) {
+	// Go through all globals and identify any variables we've configured,
+	// making them available as flags
+	stringArgs := map[string]*string{}
+	numArgs := map[string]*float64{}
+	boolArgs := map[string]*bool{}
+
+	// The flag_env table names environment variables to take defaults from,
+	// e.g. flag_env = {token = "MY_API_TOKEN"}. Flags still win.
+	envSources := map[string]string{}
+	if tbl, ok := L.GetGlobal("flag_env").(*lua.LTable); ok {
+		tbl.ForEach(func(k, v lua.LValue) {
+			value, ok := os.LookupEnv(v.String())
+			if !ok {
+				return
+			}
+			name := k.String()
+			switch L.GetGlobal(name).Type() {
+			case lua.LTNumber:
+				f, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					fmt.Printf("$%s must be a number for %s\n", v, name)
+					os.Exit(2)
+				}
+				L.SetGlobal(name, lua.LNumber(f))
+			case lua.LTBool:
+				b, err := strconv.ParseBool(value)
+				if err != nil {
+					fmt.Printf("$%s must be true or false for %s\n", v, name)
+					os.Exit(2)
+				}
+				L.SetGlobal(name, lua.LBool(b))
+			default:
+				L.SetGlobal(name, lua.LString(value))
+			}
+			envSources[name] = "$" + v.String()
+		})
+	}
+
+	// --set can also set values inside tables, e.g. --set server.port=80
+	var overrides setFlags
+	flag.Var(&overrides, "set", "Set a variable, with dots for table keys "+
+		"(e.g. server.host=example.com). Can be given more than once.")
+
+	// A default_<name> function works out the default for a variable that
+	// isn't set in the file, e.g. from other variables
+	computed := map[string]*lua.LFunction{}
+	globals := L.Get(lua.GlobalsIndex).(*lua.LTable)
+	globals.ForEach(func(klv lua.LValue, v lua.LValue) {
+		k := klv.String()
+		fn, ok := v.(*lua.LFunction)
+		if ok && strings.HasPrefix(k, "default_") &&
+			L.GetGlobal(k[8:]) == lua.LNil {
+			computed[k[8:]] = fn
+		}
+	})
+	computeDefaults := func() {
+		names := []string{}
+		for name := range computed {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			value, err := callFunction(L, computed[name])
+			if err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+			switch value.Type() {
+			case lua.LTString, lua.LTNumber, lua.LTBool:
+				L.SetGlobal(name, value)
+			default:
+				fmt.Printf("default_%s returned a %s, not a string, number "+
+					"or boolean\n", name, value.Type())
+				os.Exit(1)
+			}
+		}
+	}
+	computeDefaults()
+
+	globals.ForEach(func(klv lua.LValue, v lua.LValue) {
+		k := klv.String()
+		if strings.HasPrefix(k, "_") {
+			// Skip internal variables
+			return
+		}
+		if strings.HasPrefix(k, "help_") {
+			// Skip help text
+			return
+		}
+		switch v.Type() {
+		case lua.LTString, lua.LTNumber, lua.LTBool:
+			if flag.Lookup(k) != nil {
+				// Options of simplecli's own (like --set or --json) can't
+				// be used for variables as well
+				fmt.Printf("Warning: %s can't be set from the command line, "+
+					"--%s is already an option\n", k, k)
+				return
+			}
+			source := "lua file"
+			if _, ok := computed[k]; ok {
+				source = "default_" + k
+			}
+			for file, names := range pluginGlobals {
+				for _, name := range names {
+					if name == k {
+						source = "plugin " + filepath.Base(file)
+					}
+				}
+			}
+			if stateNames[k] {
+				source = "state file"
+			}
+			if env, ok := envSources[k]; ok {
+				source = env
+			}
+			configSources[k] = source
+		}
+		switch t := v.Type(); t {
+		case lua.LTString:
+			stringArgs[k] = flag.String(k, v.String(), "Set "+k)
+		case lua.LTNumber:
+			num := float64(v.(lua.LNumber))
+			numArgs[k] = flag.Float64(k, num, "Set "+k)
+		case lua.LTBool:
+			boolArgs[k] = flag.Bool(k, lua.LVAsBool(v), "Set "+k)
+		}
+	})
+	flag.Parse()
+	if *sandbox != sandboxRequested() {
+		// The libraries were loaded (or not) before the flags were parsed,
+		// so refuse to carry on rather than run with the wrong ones
+		fmt.Println("Error: --sandbox has to be given before any command, " +
+			"as --sandbox or --sandbox=true")
+		os.Exit(2)
+	}
+	for k, v := range stringArgs {
+		L.SetGlobal(k, lua.LString(*v))
+	}
+	for k, v := range numArgs {
+		L.SetGlobal(k, lua.LNumber(*v))
+	}
+	for k, v := range boolArgs {
+		L.SetGlobal(k, lua.LBool(*v))
+	}
+	// Work the computed defaults out again now the flags have been set, so
+	// they follow the variables they depend on
+	flag.Visit(func(f *flag.Flag) {
+		delete(computed, f.Name)
+		if _, ok := configSources[f.Name]; ok {
+			configSources[f.Name] = "flag"
+		}
+	})
+	computeDefaults()
+	for _, override := range overrides {
+		if err := setDottedVariable(L, override); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(2)
+		}
+		configSources[strings.SplitN(override, "=", 2)[0]] = "--set"
+	}
+	for name := range configSources {
+		configValues[name] = dottedValue(L, name)
+	}
+}
+
+// configSources says where each variable that can be set from the command
+// line got its value from, and configValues is the value it had then, so the
+// config built in can tell if it has been changed since
+var configSources = map[string]string{}
+var configValues = map[string]lua.LValue{}
+
+func dottedValue(L *lua.LState, name string) lua.LValue {
+	// Looks up a variable by a name like the ones --set takes, with dots for
+	// table keys
+	var value lua.LValue = L.Get(lua.GlobalsIndex)
+	for _, key := range strings.Split(name, ".") {
+		tbl, ok := value.(*lua.LTable)
+		if !ok {
+			return lua.LNil
+		}
+		value = L.GetField(tbl, key)
+	}
+	return value
+}
+
+// snapshots are the variables saved by the snapshot built in, by name
+var snapshots = map[string]map[string]lua.LValue{}
+
+func snapshotName(args []string) string {
+	if len(args) > 0 {
+		return args[0]
+	}
+	return "default"
+}
+
+func dataGlobals(L *lua.LState) map[string]lua.LValue {
+	// Returns copies of the globals that hold plain values: strings,
+	// numbers, booleans, and tables of them. Internal variables and tables
+	// with functions in (like the lua libraries) are left out.
+	values := map[string]lua.LValue{}
+	L.Get(lua.GlobalsIndex).(*lua.LTable).ForEach(func(k, v lua.LValue) {
+		name := k.String()
+		if strings.HasPrefix(name, "_") {
+			return
+		}
+		if v, ok := copyData(L, v, map[*lua.LTable]bool{}); ok {
+			values[name] = v
+		}
+	})
+	return values
+}
+
+func copyData(L *lua.LState, v lua.LValue, seen map[*lua.LTable]bool) (lua.LValue, bool) {
+	// Returns a deep copy of a value, or false if it isn't plain data
+	switch v := v.(type) {
+	case lua.LString, lua.LNumber, lua.LBool:
+		return v, true
+	case *lua.LTable:
+		if seen[v] {
+			return nil, false
+		}
+		seen[v] = true
+		copied := L.NewTable()
+		ok := true
+		v.ForEach(func(key, value lua.LValue) {
+			if c, isData := copyData(L, value, seen); isData && ok {
+				copied.RawSet(key, c)
+			} else {
+				ok = false
+			}
+		})
+		delete(seen, v)
+		return copied, ok
+	}
+	return nil, false
+}
+
+func takeSnapshot(L *lua.LState, args []string) commandStatus {
+	name := snapshotName(args)
+	snapshots[name] = dataGlobals(L)
+	fmt.Printf("Saved snapshot %s (%d variables)\n", name, len(snapshots[name]))
+	return statusOK
+}
+
+func restoreSnapshot(L *lua.LState, args []string) commandStatus {
+	// Puts variables back how they were in a snapshot. Variables set since
+	// then are removed.
+	name := snapshotName(args)
+	snapshot, ok := snapshots[name]
+	if !ok {
+		fmt.Println("No snapshot named", name)
+		return statusError
+	}
+	for k := range dataGlobals(L) {
+		if _, ok := snapshot[k]; !ok {
+			L.SetGlobal(k, lua.LNil)
+		}
+	}
+	for k, v := range snapshot {
+		// Copy again, so the snapshot can be restored more than once
+		v, _ = copyData(L, v, map[*lua.LTable]bool{})
+		L.SetGlobal(k, v)
+	}
+	fmt.Println("Restored snapshot", name)
+	return statusOK
+}
+
+func printConfig(L *lua.LState) {
+	// Shows the value of every variable that can be set from the command
+	// line, and where the value came from
+	names := []string{}
+	width := 0
+	for name := range configSources {
+		names = append(names, name)
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := dottedValue(L, name)
+		source := configSources[name]
+		if value != configValues[name] {
+			source = "changed while running"
+		}
+		fmt.Printf("%s%s = %s (%s)\n", colorize(L, "key", name),
+			strings.Repeat(" ", width-len(name)),
+			colorize(L, "value", value.String()), source)
+	}
+}
+
+// setFlags holds the values of a flag that can be given more than once
+type setFlags []string
+
+func (s *setFlags) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *setFlags) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return errors.New("expected key=value")
+	}
+	*s = append(*s, value)
+	return nil
+}
+
+func setDottedVariable(L *lua.LState, override string) error {
+	// Sets a variable from a key=value string, where the key can contain
+	// dots to set values in (possibly new) tables, e.g. server.host=foo
+	parts := strings.SplitN(override, "=", 2)
+	return setDottedValue(L, parts[0], guessValue(parts[1]))
+}
+
+func setDottedValue(L *lua.LState, name string, value lua.LValue) error {
+	keys := strings.Split(name, ".")
+	tbl := L.Get(lua.GlobalsIndex).(*lua.LTable)
+	for i, key := range keys[:len(keys)-1] {
+		switch next := L.GetField(tbl, key).(type) {
+		case *lua.LTable:
+			tbl = next
+		case *lua.LNilType:
+			newtbl := L.NewTable()
+			L.SetField(tbl, key, newtbl)
+			tbl = newtbl
+		default:
+			return fmt.Errorf("Can't set %s: %s isn't a table", name,
+				strings.Join(keys[:i+1], "."))
+		}
+	}
+	L.SetField(tbl, keys[len(keys)-1], value)
+	return nil
+}
+
+func guessValue(value string) lua.LValue {
+	// Converts a string to a lua number or boolean if it looks like one
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return lua.LNumber(f)
+	}
+	if value == "true" || value == "false" {
+		return lua.LBool(value == "true")
+	}
+	return lua.LString(value)
+}
+
+func useColor(L *lua.LState) bool {
+	// Color is only used when writing to a terminal, and can be turned off
+	// by setting NO_COLOR or _no_color
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return false
+	}
+	if lua.LVAsBool(L.GetGlobal("_no_color")) {
+		return false
+	}
+	return term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// colors are the ANSI codes for the color names themes can use
+var colors = map[string]string{
+	"black":   "30",
+	"red":     "31",
+	"green":   "32",
+	"yellow":  "33",
+	"blue":    "34",
+	"magenta": "35",
+	"cyan":    "36",
+	"white":   "37",
+	"bold":    "1",
+	"dim":     "2",
+	"reset":   "0",
+}
+
+// themes are the built in themes for --theme, mapping each role to a color
+// name. A role with no color is left alone.
+var themes = map[string]map[string]string{
+	"default": {
+		"error":   "red",
+		"success": "green",
+		"header":  "bold",
+		"key":     "cyan",
+		"value":   "yellow",
+	},
+	"bright": {
+		"prompt":  "cyan",
+		"error":   "magenta",
+		"success": "green",
+		"header":  "yellow",
+		"key":     "blue",
+		"value":   "green",
+	},
+	"none": {},
+}
+
+func themeColor(L *lua.LState, role string) string {
+	// Returns the color name for a role, from the theme table if it has
+	// one, otherwise from the built in theme chosen with --theme
+	if theme, ok := L.GetGlobal("theme").(*lua.LTable); ok {
+		if c, ok := L.GetField(theme, role).(lua.LString); ok {
+			return string(c)
+		}
+	}
+	return themes[*themeName][role]
+}
+
+func colorize(L *lua.LState, role string, text string) string {
+	// Colors text for a theme role (or a color name) when writing to a
+	// terminal
+	if !useColor(L) {
+		return text
+	}
+	color := themeColor(L, role)
+	if color == "" {
+		color = role
+	}
+	code, ok := colors[color]
+	if !ok {
+		return text
+	}
+	return "\033[" + code + "m" + text + "\033[0m"
+}
+
+func printKeyValue(L *lua.LState, key string, value string, width int) {
+	// Prints key=value, with the key padded to width so that several can be
+	// lined up, and colored when writing to a terminal
+	padding := ""
+	if width > len(key) {
+		padding = strings.Repeat(" ", width-len(key))
+	}
+	fmt.Printf("%s%s=%s\n", colorize(L, "key", key), padding,
+		colorize(L, "value", value))
+}
+
+func cliColor(L *lua.LState) int {
+	// Returns text colored for a theme role or color name, as
+	// cli_color(text, color). The cli_color(role, text) order still works:
+	// if only the first argument is a role or color, it's used as the color.
+	text, color := L.CheckString(1), L.CheckString(2)
+	if !isColorName(L, color) && isColorName(L, text) {
+		text, color = color, text
+	}
+	L.Push(lua.LString(colorize(L, color, text)))
+	return 1
+}
+
+func isColorName(L *lua.LState, name string) bool {
+	// Returns true if name is a color or a role in any theme
+	if _, ok := colors[name]; ok || themeColor(L, name) != "" {
+		return true
+	}
+	for _, theme := range themes {
+		if _, ok := theme[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func cliKv(L *lua.LState) int {
+	// Prints name=value, or every key=value in a table sorted by key and
+	// lined up
+	if tbl, ok := L.Get(1).(*lua.LTable); ok {
+		values := map[string]string{}
+		keys := []string{}
+		width := 0
+		tbl.ForEach(func(k, v lua.LValue) {
+			values[k.String()] = v.String()
+			keys = append(keys, k.String())
+			if len(k.String()) > width {
+				width = len(k.String())
+			}
+		})
+		sort.Strings(keys)
+		for _, k := range keys {
+			printKeyValue(L, k, values[k], width)
+		}
+		return 0
+	}
+	printKeyValue(L, L.CheckString(1), L.ToString(2), 0)
+	return 0
+}
+
+func cliFormat(L *lua.LState) int {
+	// Formats values like go's fmt.Sprintf. Numbers work with both integer
+	// verbs (%d, %x) and float verbs (%f, %g), and tables are shown as JSON
+	// (indented with %+v).
+	layout := L.CheckString(1)
+	values := []interface{}{}
+	for i := 2; i <= L.GetTop(); i++ {
+		switch v := L.Get(i).(type) {
+		case lua.LNumber:
+			values = append(values, formatNumber(v))
+		case *lua.LTable:
+			value, err := luaToGo(v)
+			if err != nil {
+				L.ArgError(i, err.Error())
+			}
+			values = append(values, formatTable{value})
+		case *lua.LNilType:
+			values = append(values, "nil")
+		default:
+			value, _ := luaToGo(v)
+			values = append(values, value)
+		}
+	}
+	L.Push(lua.LString(fmt.Sprintf(layout, values...)))
+	return 1
+}
+
+// formatNumber is a lua number for cli_format, which is an integer for the
+// integer verbs and a float for everything else
+type formatNumber float64
+
+func (n formatNumber) Format(f fmt.State, verb rune) {
+	switch verb {
+	case 'd', 'x', 'X', 'o', 'O', 'b', 'c', 'q', 'U':
+		fmt.Fprintf(f, fmt.FormatString(f, verb), int64(n))
+	case 'v', 's':
+		fmt.Fprintf(f, fmt.FormatString(f, 's'), lua.LNumber(n).String())
+	default:
+		fmt.Fprintf(f, fmt.FormatString(f, verb), float64(n))
+	}
+}
+
+// formatTable is a lua table for cli_format, shown as JSON
+type formatTable struct {
+	value interface{}
+}
+
+func (t formatTable) Format(f fmt.State, verb rune) {
+	var out []byte
+	var err error
+	if f.Flag('+') {
+		out, err = json.MarshalIndent(t.value, "", "  ")
+	} else {
+		out, err = json.Marshal(t.value)
+	}
+	if err != nil {
+		fmt.Fprintf(f, "%%!%c(%s)", verb, err)
+		return
+	}
+	fmt.Fprintf(f, fmt.FormatString(f, 's'), string(out))
+}
+
+func cliPrint(L *lua.LState) int {
+	// Prints its arguments separated by spaces, like print. If there's more
+	// than one argument and the last is "stdout" or "stderr", it says where
+	// the output goes. Output to stdout is left out when _quiet is set.
+	n := L.GetTop()
+	out := os.Stdout
+	if n > 1 {
+		switch L.Get(n) {
+		case lua.LString("stderr"):
+			out = os.Stderr
+			n--
+		case lua.LString("stdout"):
+			n--
+		}
+	}
+	if out == os.Stdout && lua.LVAsBool(L.GetGlobal("_quiet")) {
+		return 0
+	}
+	parts := make([]string, n)
+	for i := 1; i <= n; i++ {
+		parts[i-1] = L.ToStringMeta(L.Get(i)).String()
+	}
+	fmt.Fprintln(out, strings.Join(parts, " "))
+	return 0
+}
+
+func cliVariable(L *lua.LState) int {
+	varname := L.ToString(1)
 	value := L.ToString(2)
 	vartype := L.GetGlobal(varname).Type()
 	if value != "" {
@@ -224,279 +3955,1746 @@ func cliVariable(L *lua.LState) int {
 					varname)
 				return 0
 			}
-			L.SetGlobal(varname, lua.LNumber(f))
+			L.SetGlobal(varname, lua.LNumber(f))
+		} else {
+			L.SetGlobal(varname, lua.LString(value))
+		}
+	}
+	printKeyValue(L, varname, L.GetGlobal(varname).String(), 0)
+	return 0 // Number of results
+}
+
+func changeDir(L *lua.LState, varname string, value string) {
+	// Sets a virtual current directory variable the same way cd would,
+	// relative to its current value
+	if len(value) == 0 {
+		L.SetGlobal(varname, lua.LString("/"))
+	} else if strings.HasPrefix(value, "/") {
+		L.SetGlobal(varname, lua.LString(value))
+	} else {
+		parts := strings.Split(value, "/")
+		oldvalue := L.GetGlobal(varname).String()
+		if oldvalue == "" {
+			L.SetGlobal(varname, lua.LString("/"))
+		}
+		cwd := strings.Split(oldvalue[1:], "/")
+		if cwd[len(cwd)-1] == "" {
+			cwd = cwd[:len(cwd)-1]
+		}
+		if len(cwd) == 1 && cwd[0] == "" {
+			cwd = []string{}
+		}
+		for _, part := range parts {
+			if part == "." {
+				continue
+			} else if part == ".." {
+				if len(cwd) > 0 {
+					cwd = cwd[:len(cwd)-1]
+				}
+			} else {
+				cwd = append(cwd, part)
+			}
+		}
+		newvalue := "/" + strings.Join(cwd, "/")
+		if !strings.HasSuffix(newvalue, "/") {
+			newvalue = newvalue + "/"
+		}
+		L.SetGlobal(varname, lua.LString(newvalue))
+	}
+}
+
+func cliCd(L *lua.LState) int {
+	varname := L.ToString(1)
+	changeDir(L, varname, L.ToString(2))
+	printKeyValue(L, varname, L.GetGlobal(varname).String(), 0)
+	return 0 // Number of results
+}
+
+// dirStacks holds the directories saved by cli_pushd for each variable
+var dirStacks = map[string][]string{}
+
+func cliPushd(L *lua.LState) int {
+	varname := L.ToString(1)
+	dirStacks[varname] = append(dirStacks[varname],
+		L.GetGlobal(varname).String())
+	changeDir(L, varname, L.ToString(2))
+	printKeyValue(L, varname, L.GetGlobal(varname).String(), 0)
+	return 0 // Number of results
+}
+
+func cliPopd(L *lua.LState) int {
+	varname := L.ToString(1)
+	stack := dirStacks[varname]
+	if len(stack) == 0 {
+		fmt.Println("Directory stack is empty")
+		return 0
+	}
+	L.SetGlobal(varname, lua.LString(stack[len(stack)-1]))
+	dirStacks[varname] = stack[:len(stack)-1]
+	printKeyValue(L, varname, L.GetGlobal(varname).String(), 0)
+	return 0 // Number of results
+}
+
+func printDirStacks(L *lua.LState) {
+	// Shows the current directory followed by the saved ones, most recent
+	// first, for each variable used with cli_pushd
+	names := []string{}
+	for name := range dirStacks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dirs := []string{L.GetGlobal(name).String()}
+		stack := dirStacks[name]
+		for i := len(stack) - 1; i >= 0; i-- {
+			dirs = append(dirs, stack[i])
+		}
+		printKeyValue(L, name, strings.Join(dirs, " "), 0)
+	}
+}
+
+func cliEnvvar(L *lua.LState) int {
+	varname := L.ToString(1)
+	value := L.ToString(2)
+	if value != "" {
+		os.Setenv(varname, value)
+	}
+	printKeyValue(L, varname, os.Getenv(varname), 0)
+	return 0 // Number of results
+}
+
+func cliWithEnv(L *lua.LState) int {
+	// Calls fn with the environment variables in env set, putting the old
+	// values back afterwards even if fn raises an error. Returns whatever fn
+	// returns.
+	env := L.CheckTable(1)
+	fn := L.CheckFunction(2)
+	type saved struct {
+		value string
+		set   bool
+	}
+	old := map[string]saved{}
+	env.ForEach(func(k, v lua.LValue) {
+		name := k.String()
+		if _, ok := old[name]; !ok {
+			value, set := os.LookupEnv(name)
+			old[name] = saved{value, set}
+		}
+		os.Setenv(name, v.String())
+	})
+	defer func() {
+		for name, s := range old {
+			if s.set {
+				os.Setenv(name, s.value)
+			} else {
+				os.Unsetenv(name)
+			}
+		}
+	}()
+
+	top := L.GetTop()
+	if err := L.CallByParam(lua.P{
+		Fn:      fn,
+		NRet:    lua.MultRet,
+		Protect: true,
+	}); err != nil {
+		// Raise the original error (not a copy with a new stack trace) once
+		// the environment is back
+		var apiErr *lua.ApiError
+		if errors.As(err, &apiErr) {
+			L.Error(apiErr.Object, 0)
+		}
+		L.RaiseError("%s", err.Error())
+	}
+	return L.GetTop() - top
+}
+
+// rollbacks are the functions registered with cli_defer, for each
+// cli_transaction that is running (innermost last)
+var rollbacks [][]*lua.LFunction
+
+func cliTransaction(L *lua.LState) int {
+	// Calls fn, and if it raises an error, calls the functions it registered
+	// with cli_defer in reverse order before raising the error again. When a
+	// transaction inside another one succeeds, its rollbacks are passed on
+	// to the outer one. Returns whatever fn returns.
+	fn := L.CheckFunction(1)
+	rollbacks = append(rollbacks, nil)
+	top := L.GetTop()
+	err := L.CallByParam(lua.P{
+		Fn:      fn,
+		NRet:    lua.MultRet,
+		Protect: true,
+	})
+	registered := rollbacks[len(rollbacks)-1]
+	rollbacks = rollbacks[:len(rollbacks)-1]
+	if err == nil {
+		if len(rollbacks) > 0 {
+			outer := len(rollbacks) - 1
+			rollbacks[outer] = append(rollbacks[outer], registered...)
+		}
+		return L.GetTop() - top
+	}
+
+	// Rolling back shouldn't be stopped by the ^C that may have caused it
+	if ctx := L.Context(); ctx != nil {
+		L.RemoveContext()
+		defer L.SetContext(ctx)
+	}
+	var apiErr *lua.ApiError
+	for i := len(registered) - 1; i >= 0; i-- {
+		if _, rollbackErr := callFunction(L, registered[i]); rollbackErr != nil {
+			if errors.As(rollbackErr, &apiErr) {
+				rollbackErr = errors.New(apiErr.Object.String())
+			}
+			fmt.Println("Error rolling back:", rollbackErr)
+		}
+	}
+	if errors.As(err, &apiErr) {
+		L.Error(apiErr.Object, 0)
+	}
+	L.RaiseError("%s", err.Error())
+	return 0
+}
+
+func cliDefer(L *lua.LState) int {
+	// Registers a function to undo a step of the current cli_transaction
+	fn := L.CheckFunction(1)
+	if len(rollbacks) == 0 {
+		L.RaiseError("cli_defer can only be used inside cli_transaction")
+	}
+	rollbacks[len(rollbacks)-1] = append(rollbacks[len(rollbacks)-1], fn)
+	return 0
+}
+
+func cliToggle(L *lua.LState) int {
+	varname := L.ToString(1)
+	curr := lua.LVAsBool(L.GetGlobal(varname))
+	L.SetGlobal(varname, lua.LBool(!curr))
+	printKeyValue(L, varname, L.GetGlobal(varname).String(), 0)
+	return 0 // Number of results
+}
+
+func findEditor() (string, error) {
+	// Returns the first of $EDITOR, $VISUAL, vi and nano that can be found
+	candidates := []string{os.Getenv("EDITOR"), os.Getenv("VISUAL"), "vi",
+		"nano"}
+	for _, editor := range candidates {
+		if editor == "" {
+			continue
+		}
+		if _, err := exec.LookPath(editor); err == nil {
+			return editor, nil
+		}
+	}
+	return "", errors.New("could not find an editor, set $EDITOR to one")
+}
+
+func cliEdit(L *lua.LState) int {
+	checkSandbox(L, "cli_edit")
+	filename := L.ToString(1)
+	fileinfo, err := os.Stat(filename)
+	if err != nil {
+		fmt.Println("Error getting tempfile modtime:", err)
+		L.Push(lua.LBool(false))
+		return 1
+	}
+	previousModtime := fileinfo.ModTime()
+
+	editor, err := findEditor()
+	if err != nil {
+		fmt.Println(err)
+		L.Push(lua.LBool(false))
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	if err := runInteractive(exec.Command(editor, filename)); err != nil {
+		msg := fmt.Sprintf("could not launch editor '%s': %s", editor, err)
+		fmt.Println(msg)
+		L.Push(lua.LBool(false))
+		L.Push(lua.LString(msg))
+		return 2
+	}
+
+	fileinfo, err = os.Stat(filename)
+	if err != nil {
+		fmt.Println("Error getting modtime:", err)
+		L.Push(lua.LBool(false))
+		return 1
+	}
+
+	if fileinfo.ModTime() == previousModtime {
+		fmt.Println("File was unchanged")
+		L.Push(lua.LBool(false))
+		return 1
+	}
+
+	L.Push(lua.LBool(true))
+	return 1
+}
+
+// childRunning is set while an interactive program has the terminal, so that
+// ^C goes to it rather than stopping the command that started it
+var childRunning int32
+
+func runInteractive(c *exec.Cmd) error {
+	// Runs a program that takes over the terminal, such as an editor or a
+	// shell. The terminal settings are put back afterwards in case the
+	// program left them in a mess, so that readline can carry on normally.
+	if c.Stdin == nil {
+		c.Stdin = os.Stdin
+	}
+	c.Stdout = terminalStdout
+	c.Stderr = os.Stderr
+	fd := int(os.Stdin.Fd())
+	if state, err := term.GetState(fd); err == nil {
+		defer term.Restore(fd, state)
+	}
+	atomic.StoreInt32(&childRunning, 1)
+	defer atomic.StoreInt32(&childRunning, 0)
+	return c.Run()
+}
+
+func cliShell(L *lua.LState) int {
+	// Runs an interactive program such as ssh or psql, giving it the
+	// terminal until it exits. Returns the exit code, or nil and an error
+	// message if it couldn't be run.
+	checkSandbox(L, "cli_shell")
+	name := L.CheckString(1)
+	args := []string{}
+	L.OptTable(2, L.NewTable()).ForEach(func(_, v lua.LValue) {
+		args = append(args, v.String())
+	})
+	err := runInteractive(exec.Command(name, args...))
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		L.Push(lua.LNumber(exitErr.ExitCode()))
+		return 1
+	} else if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LNumber(0))
+	return 1
+}
+
+func cliExec(L *lua.LState) int {
+	// Runs a program and returns its output, the output on stderr, and the
+	// exit code, or nil and an error message if it couldn't be run. It gets
+	// no input unless opts has stdin = true, or input = "some text".
+	checkSandbox(L, "cli_exec")
+	name := L.CheckString(1)
+	args := []string{}
+	L.OptTable(2, L.NewTable()).ForEach(func(_, v lua.LValue) {
+		args = append(args, v.String())
+	})
+	opts := L.OptTable(3, L.NewTable())
+	c := exec.CommandContext(commandContext, name, args...)
+	if input, ok := L.GetField(opts, "input").(lua.LString); ok {
+		c.Stdin = strings.NewReader(string(input))
+	} else if lua.LVAsBool(L.GetField(opts, "stdin")) {
+		c.Stdin = os.Stdin
+	}
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	err := c.Run()
+	code := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LString(stdout.String()))
+	L.Push(lua.LString(stderr.String()))
+	L.Push(lua.LNumber(code))
+	return 3
+}
+
+// credentials are the secrets cli_credential has already looked up
+var credentials = map[string]string{}
+
+func cliCredential(L *lua.LState) int {
+	// Gets a secret by running the program in credential_helper with the
+	// key as its last argument, and keeps it for the rest of the session.
+	// Returns nil and an error message if there's no helper or it fails.
+	checkSandbox(L, "cli_credential")
+	key := L.CheckString(1)
+	if secret, ok := credentials[key]; ok {
+		L.Push(lua.LString(secret))
+		return 1
+	}
+	helper, ok := L.GetGlobal("credential_helper").(lua.LString)
+	if !ok || helper == "" {
+		L.Push(lua.LNil)
+		L.Push(lua.LString("credential_helper isn't set"))
+		return 2
+	}
+	parts, err := shlex.Split(string(helper))
+	if err != nil || len(parts) == 0 {
+		L.Push(lua.LNil)
+		L.Push(lua.LString("bad credential_helper: " + string(helper)))
+		return 2
+	}
+	// The helper gets the terminal for stdin and stderr, in case it needs
+	// to ask for a password to unlock a keychain
+	c := exec.CommandContext(commandContext, parts[0],
+		append(parts[1:], key)...)
+	var stdout bytes.Buffer
+	if !stdinScript {
+		c.Stdin = os.Stdin
+	}
+	c.Stdout = &stdout
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString("credential helper failed: " + err.Error()))
+		return 2
+	}
+	secret := strings.TrimRight(stdout.String(), "\r\n")
+	credentials[key] = secret
+	L.Push(lua.LString(secret))
+	return 1
+}
+
+func cliExecStream(L *lua.LState) int {
+	// Runs a program and calls line_fn with each line of its output as soon
+	// as it's written, for following logs and the like. Returns the exit
+	// code, or nil and an error message if it couldn't be run or ^C was
+	// pressed.
+	checkSandbox(L, "cli_exec_stream")
+	name := L.CheckString(1)
+	args := []string{}
+	L.OptTable(2, L.NewTable()).ForEach(func(_, v lua.LValue) {
+		args = append(args, v.String())
+	})
+	linefn := L.CheckFunction(3)
+	ctx := commandContext
+	c := exec.CommandContext(ctx, name, args...)
+	c.Stderr = os.Stderr
+	stdout, err := c.StdoutPipe()
+	if err == nil {
+		err = c.Start()
+	}
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if _, err := callFunction(L, linefn, lua.LString(scanner.Text())); err != nil {
+			c.Process.Kill()
+			c.Wait()
+			var apiErr *lua.ApiError
+			if errors.As(err, &apiErr) {
+				L.Error(apiErr.Object, 0)
+			}
+			L.RaiseError("%s", err.Error())
+		}
+	}
+	err = c.Wait()
+	if ctx.Err() != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString("interrupted"))
+		return 2
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		L.Push(lua.LNumber(exitErr.ExitCode()))
+		return 1
+	} else if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LNumber(0))
+	return 1
+}
+
+func cliTemplateFunction(L *lua.LState, funcName string) func(io.Writer, string) (int, error) {
+	// Returns a go function that calls a lua function by name. Used to
+	// implement calling lua functions from template strings. Anything after
+	// a : in the tag is passed as a parameter, e.g. {{greet:World}} calls
+	// greet("World"), and {{greet}} calls greet().
+	return func(buf io.Writer, tag string) (int, error) {
+		args := []lua.LValue{}
+		if i := strings.Index(tag, ":"); i != -1 {
+			args = append(args, lua.LString(tag[i+1:]))
+		}
+		err := L.CallByParam(lua.P{
+			Fn:      L.GetGlobal(funcName),
+			NRet:    1,
+			Protect: true,
+		}, args...)
+		if err != nil {
+			return 0, err
+		}
+		retval := L.Get(-1).String()
+		L.Pop(1)
+		return buf.Write([]byte(retval))
+	}
+}
+
+func templateVars(L *lua.LState) map[string]interface{} {
+	// Returns the variables available to templates
+	vars := map[string]interface{}{}
+	// First, make environment variables available in templates
+	for _, envstr := range os.Environ() {
+		parts := strings.SplitN(envstr, "=", 2)
+		vars[parts[0]] = parts[1]
+	}
+	// {{uuid}} gives a new uuid each time, unless there's a uuid global
+	vars["uuid"] = fasttemplate.TagFunc(func(w io.Writer, tag string) (int, error) {
+		return w.Write([]byte(newUUID(randomSource(L))))
+	})
+	// Next, make all lua global variables and functions available as
+	// template variables
+	globals := L.Get(lua.GlobalsIndex).(*lua.LTable)
+	globals.ForEach(func(klv lua.LValue, v lua.LValue) {
+		k := klv.String()
+		if strings.HasPrefix(k, "_") {
+			// Skip internal variables
+			return
+		}
+		switch t := v.Type(); t {
+		case lua.LTString:
+			vars[k] = v.String()
+		case lua.LTNumber:
+			vars[k] = v.String()
+		case lua.LTBool:
+			vars[k] = v.String()
+		case lua.LTFunction:
+			vars[k] = fasttemplate.TagFunc(cliTemplateFunction(L, k))
+		case lua.LTTable:
+			// Tables are accessible with {{tblname[key]}}
+			// e.g. foo[bar] or foo[1]
+			tbl := v.(*lua.LTable)
+			tbl.ForEach(func(tblk lua.LValue, tblv lua.LValue) {
+				vars[k+"["+tblk.String()+"]"] = tblv.String()
+			})
+		}
+	})
+	// The session id is internal, but useful in templates
+	vars["_session_id"] = L.GetGlobal("_session_id").String()
+	// Add local variables too
+	debug, ok := L.GetStack(-1)
+	if ok {
+		idx := 1
+		for {
+			k, v := L.GetLocal(debug, idx)
+			if k == "" {
+				break
+			}
+			tbl, ok := v.(*lua.LTable)
+			if ok {
+				// Tables are accessible with tblname[key]
+				// e.g. foo[bar] or foo[1] or args[1]
+				tbl.ForEach(func(tblk lua.LValue, tblv lua.LValue) {
+					vars[k+"["+tblk.String()+"]"] = tblv.String()
+				})
+			} else {
+				vars[k] = v.String()
+			}
+			idx++
+		}
+	}
+
+	return vars
+}
+
+func cliTemplate(L *lua.LState) int {
+	t, err := parseTemplate(L, L.ToString(1))
+	if err != nil {
+		fmt.Println(err.Error())
+		return 0
+	}
+	text, err := executeTemplate(L, t)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 0
+	}
+	L.Push(lua.LString(text))
+	return 1
+}
+
+func cliTemplateFile(L *lua.LState) int {
+	// Renders a template file, returning nil and an error message if it
+	// can't be read
+	filename := L.CheckString(1)
+	checkSandbox(L, "cli_template_file")
+	text, err := renderTemplateFile(L, filename)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LString(text))
+	return 1
+}
+
+func parseTemplate(L *lua.LState, text string) (*fasttemplate.Template, error) {
+	startTag, endTag, err := templateDelimiters(L)
+	if err != nil {
+		return nil, err
+	}
+	return fasttemplate.NewTemplate(text, startTag, endTag)
+}
+
+func templateDelimiters(L *lua.LState) (string, string, error) {
+	// Templates use {{ and }} unless _template_open and _template_close say
+	// otherwise, for text that has double braces of its own
+	startTag, endTag := "{{", "}}"
+	if v, ok := L.GetGlobal("_template_open").(lua.LString); ok {
+		startTag = string(v)
+	}
+	if v, ok := L.GetGlobal("_template_close").(lua.LString); ok {
+		endTag = string(v)
+	}
+	if startTag == "" || endTag == "" {
+		return "", "", errors.New("Template delimiters can't be empty")
+	}
+	if startTag == endTag {
+		return "", "", fmt.Errorf("_template_open and _template_close "+
+			"must be different, they're both %q", startTag)
+	}
+	return startTag, endTag, nil
+}
+
+func executeTemplate(L *lua.LState, t *fasttemplate.Template) (string, error) {
+	// Renders a template with the variables from templateVars. A tag can end
+	// with modifiers for values with newlines in them: {{name|oneline}} puts
+	// everything on one line, and {{name|indent}} indents every line after
+	// the first.
+	vars := templateVars(L)
+	if lua.LVAsBool(L.GetGlobal("template_profile")) {
+		profile := profileTemplateFuncs(vars)
+		defer profile.print()
+	}
+	return t.ExecuteFuncStringWithErr(func(w io.Writer, tag string) (int, error) {
+		parts := strings.Split(tag, "|")
+		var value string
+		v, ok := vars[parts[0]]
+		if !ok {
+			// Functions can be given a parameter with {{name:param}}
+			name := strings.SplitN(parts[0], ":", 2)[0]
+			if fn, isFunc := vars[name].(fasttemplate.TagFunc); isFunc {
+				v = fn
+			}
+		}
+		switch v := v.(type) {
+		case string:
+			value = v
+		case fasttemplate.TagFunc:
+			var buf bytes.Buffer
+			if _, err := v(&buf, parts[0]); err != nil {
+				return 0, err
+			}
+			value = buf.String()
+		default:
+			return 0, nil
+		}
+		for _, modifier := range parts[1:] {
+			switch modifier {
+			case "oneline":
+				value = strings.Join(
+					strings.Split(strings.TrimRight(value, "\n"), "\n"), " ")
+			case "indent":
+				lines := strings.TrimRight(value, "\n")
+				value = strings.Replace(lines, "\n", "\n  ", -1) +
+					value[len(lines):]
+			default:
+				return 0, fmt.Errorf("unknown template modifier %q", modifier)
+			}
+		}
+		return w.Write([]byte(value))
+	})
+}
+
+// templateProfile is the time spent in each function called from a
+// template, for template_profile
+type templateProfile map[string]*templateTiming
+
+type templateTiming struct {
+	calls int
+	total time.Duration
+}
+
+func profileTemplateFuncs(vars map[string]interface{}) templateProfile {
+	// Wraps each function in the template variables so the time spent in it
+	// is recorded
+	profile := templateProfile{}
+	for name, v := range vars {
+		fn, ok := v.(fasttemplate.TagFunc)
+		if !ok {
+			continue
+		}
+		name, fn := name, fn
+		timing := &templateTiming{}
+		profile[name] = timing
+		vars[name] = fasttemplate.TagFunc(func(w io.Writer, tag string) (int, error) {
+			start := time.Now()
+			defer func() {
+				timing.calls++
+				timing.total += time.Since(start)
+			}()
+			return fn(w, tag)
+		})
+	}
+	return profile
+}
+
+func (p templateProfile) print() {
+	// Shows the functions that were called, slowest first. This goes to
+	// stderr so it doesn't end up in the rendered text.
+	names := []string{}
+	var total time.Duration
+	for name, timing := range p {
+		if timing.calls > 0 {
+			names = append(names, name)
+			total += timing.total
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return p[names[i]].total > p[names[j]].total
+	})
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "%-30s %s (%d calls)\n", name,
+			p[name].total, p[name].calls)
+	}
+	fmt.Fprintf(os.Stderr, "%-30s %s\n", "total", total)
+}
+
+// cachedTemplate is a parsed template file, along with the modification time
+// of the file when it was read and the delimiters it was parsed with
+type cachedTemplate struct {
+	modTime    time.Time
+	delimiters [2]string
+	template   *fasttemplate.Template
+}
+
+var templateFiles = map[string]*cachedTemplate{}
+
+func renderTemplateFile(L *lua.LState, filename string) (string, error) {
+	// Renders a template file, only reading and parsing it again if it has
+	// changed since last time
+	fileinfo, err := os.Stat(filename)
+	if err != nil {
+		return "", err
+	}
+	startTag, endTag, err := templateDelimiters(L)
+	if err != nil {
+		return "", err
+	}
+	delimiters := [2]string{startTag, endTag}
+	cached, ok := templateFiles[filename]
+	if !ok || !cached.modTime.Equal(fileinfo.ModTime()) ||
+		cached.delimiters != delimiters {
+		contents, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return "", err
+		}
+		t, err := parseTemplate(L, string(contents))
+		if err != nil {
+			return "", err
+		}
+		cached = &cachedTemplate{modTime: fileinfo.ModTime(),
+			delimiters: delimiters, template: t}
+		templateFiles[filename] = cached
+	}
+	return executeTemplate(L, cached.template)
+}
+
+func renderGlobalTemplateFile(L *lua.LState, varname string) (string, bool) {
+	// Renders the template file named by a global variable. Returns false if
+	// the variable isn't set or the file doesn't exist, so the caller can
+	// fall back to something else.
+	// The file is read by simplecli, so it's ignored with --sandbox
+	filename := L.GetGlobal(varname)
+	if filename.Type() != lua.LTString || sandboxRequested() {
+		return "", false
+	}
+	text, err := renderTemplateFile(L, filename.String())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println("Error reading template:", err)
+		}
+		return "", false
+	}
+	return text, true
+}
+
+func autocompleteFunc(L *lua.LState, funcobj *lua.LFunction) func(string) []string {
+	// Returns a go function that calls a lua autocomplete function by name.
+	return func(line string) []string {
+		err := L.CallByParam(lua.P{
+			Fn:      funcobj,
+			NRet:    1,
+			Protect: true,
+		}, lua.LString(line))
+		if err != nil {
+			return []string{}
+		}
+		retval, ok := L.Get(-1).(*lua.LTable)
+		L.Pop(1)
+		if !ok {
+			fmt.Println("Autocomplete error: function didn't return a table")
+			return []string{}
+		}
+		items := []string{}
+		retval.ForEach(func(klv lua.LValue, v lua.LValue) {
+			items = append(items, v.String())
+		})
+		return items
+	}
+}
+
+// luaCompleter handles tab completion. Arguments for commands with a
+// complete_<cmd> or list_<cmd> function are completed by calling it, and
+// everything else (including command names) is handled by the prefix
+// completer from commandCompleter.
+type luaCompleter struct {
+	L  *lua.LState
+	rl *readline.Instance
+}
+
+// completion is a single completion candidate, with an optional description
+// shown when listing candidates
+type completion struct {
+	value string
+	desc  string
+}
+
+func (c *luaCompleter) Do(line []rune, pos int) ([][]rune, int) {
+	// Completion happens while the main loop is waiting for input, so we
+	// need to take the lock before calling into lua
+	luaLock.Lock()
+	defer luaLock.Unlock()
+
+	text := string(line[:pos])
+	fields := strings.Fields(text)
+	if len(fields) > 1 || (len(fields) == 1 && strings.HasSuffix(text, " ")) {
+		fn, ok := c.L.GetGlobal("complete_" + fields[0]).(*lua.LFunction)
+		if ok {
+			return c.complete(fn, text)
+		}
+		fn, ok = c.L.GetGlobal("list_" + fields[0]).(*lua.LFunction)
+		if ok {
+			return c.completePath(fn, text)
+		}
+	}
+	return commandCompleter(c.L).Do(line, pos)
+}
+
+func (c *luaCompleter) completePath(fn *lua.LFunction, text string) ([][]rune, int) {
+	// list_ functions are given the directory part of the word being
+	// completed (e.g. "a/b/" for "a/b/c", or "" for "c"), and return the
+	// names in it, with a / on the end of directories. Only the last part
+	// of the path is completed, so it works one directory at a time.
+	partial := text[strings.LastIndex(text, " ")+1:]
+	dir := partial[:strings.LastIndex(partial, "/")+1]
+	base := partial[len(dir):]
+	if err := c.L.CallByParam(lua.P{
+		Fn:      fn,
+		NRet:    1,
+		Protect: true,
+	}, lua.LString(dir)); err != nil {
+		return nil, 0
+	}
+	retval, ok := c.L.Get(-1).(*lua.LTable)
+	c.L.Pop(1)
+	if !ok {
+		fmt.Println("Autocomplete error: function didn't return a table")
+		return nil, 0
+	}
+	items := [][]rune{}
+	retval.ForEach(func(_, v lua.LValue) {
+		name := v.String()
+		if strings.HasPrefix(name, base) {
+			items = append(items, []rune(name[len(base):]))
+		}
+	})
+	// A single file is complete, but directories can carry on
+	if len(items) == 1 && !strings.HasSuffix(string(items[0]), "/") {
+		items[0] = append(items[0], ' ')
+	}
+	// readline counts the offset in runes, not bytes
+	return items, utf8.RuneCountInString(base)
+}
+
+func (c *luaCompleter) complete(fn *lua.LFunction, text string) ([][]rune, int) {
+	// complete_ functions are given a table of the arguments typed so far
+	// and the word being completed, and return a table of candidates (or
+	// nil for none). Each candidate is either a string, or a table with
+	// value and desc keys.
+	partial := text[strings.LastIndex(text, " ")+1:]
+	args := strings.Fields(text)[1:]
+	if partial != "" {
+		args = args[:len(args)-1]
+	}
+	typed := c.L.NewTable()
+	for _, arg := range args {
+		typed.Append(lua.LString(arg))
+	}
+	if err := c.L.CallByParam(lua.P{
+		Fn:      fn,
+		NRet:    1,
+		Protect: true,
+	}, typed, lua.LString(partial)); err != nil {
+		fmt.Println("Autocomplete error:", err)
+		return nil, 0
+	}
+	ret := c.L.Get(-1)
+	c.L.Pop(1)
+	if ret == lua.LNil {
+		return nil, 0
+	}
+	retval, ok := ret.(*lua.LTable)
+	if !ok {
+		fmt.Println("Autocomplete error: function didn't return a table")
+		return nil, 0
+	}
+	candidates := []completion{}
+	hasDesc := false
+	retval.ForEach(func(_, v lua.LValue) {
+		item := completion{value: v.String()}
+		if tbl, ok := v.(*lua.LTable); ok {
+			item.value = c.L.GetField(tbl, "value").String()
+			if desc := c.L.GetField(tbl, "desc"); desc != lua.LNil {
+				item.desc = desc.String()
+				hasDesc = true
+			}
+		}
+		if strings.HasPrefix(item.value, partial) {
+			candidates = append(candidates, item)
+		}
+	})
+
+	if len(candidates) == 0 {
+		return nil, 0
+	}
+	values := []string{}
+	for _, item := range candidates {
+		values = append(values, item.value)
+	}
+	common := commonPrefix(values)
+	// readline counts the offset in runes, not bytes
+	offset := utf8.RuneCountInString(partial)
+
+	// With max_completions set, only that many candidates are shown. The
+	// shortest are kept, as they're the closest to what has been typed.
+	more := 0
+	if n, ok := c.L.GetGlobal("max_completions").(lua.LNumber); ok &&
+		n > 0 && len(candidates) > int(n) {
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return len(candidates[i].value) < len(candidates[j].value)
+		})
+		more = len(candidates) - int(n)
+		candidates = candidates[:int(n)]
+	}
+
+	switch {
+	case len(candidates) == 1 && more == 0:
+		return [][]rune{[]rune(candidates[0].value[len(partial):] + " ")},
+			offset
+	case !hasDesc && more == 0:
+		items := [][]rune{}
+		for _, item := range candidates {
+			items = append(items, []rune(item.value[len(partial):]))
+		}
+		return items, offset
+	}
+
+	// readline can only list plain strings, so print candidates with
+	// descriptions (or a cut down list) ourselves and just complete as far
+	// as they agree
+	width := 0
+	for _, item := range candidates {
+		if n := utf8.RuneCountInString(item.value); n > width {
+			width = n
+		}
+	}
+	listing := ""
+	for _, item := range candidates {
+		if hasDesc {
+			listing += fmt.Sprintf("%-*s  %s\n", width, item.value, item.desc)
 		} else {
-			L.SetGlobal(varname, lua.LString(value))
+			listing += item.value + "\n"
+		}
+	}
+	if more > 0 {
+		listing += fmt.Sprintf("(%d more...)\n", more)
+	}
+	c.rl.Stdout().Write([]byte(listing))
+	if len(common) > len(partial) {
+		return [][]rune{[]rune(common[len(partial):])}, offset
+	}
+	return nil, 0
+}
+
+func commonPrefix(values []string) string {
+	// Returns the longest prefix all of values start with. It's worked out
+	// a character at a time, so it never ends halfway through one.
+	if len(values) == 0 {
+		return ""
+	}
+	common := []rune(values[0])
+	for _, value := range values[1:] {
+		runes := []rune(value)
+		n := 0
+		for n < len(common) && n < len(runes) && common[n] == runes[n] {
+			n++
+		}
+		common = common[:n]
+	}
+	return string(common)
+}
+
+func setupAutocomplete(rl *readline.Instance, L *lua.LState) {
+	rl.Config.AutoComplete = &luaCompleter{L: L, rl: rl}
+}
+
+// warnedAutocomplete records the commands we've already warned about having
+// a bad autocomplete_ variable, so the warning isn't repeated on every tab
+var warnedAutocomplete = map[string]bool{}
+
+func commandCompleter(L *lua.LState) *readline.PrefixCompleter {
+	// Builds a completer for command names (do_ functions and the built in
+	// commands) and the autocomplete_ tables. It's rebuilt for each
+	// completion so that commands defined since startup are included.
+	// With children: readline.PcItem("test", readline.PcItem("foo"))
+	// Dynamic: readline.PcItemDynamic(someFunction("foo"), children...)
+	// type DynamicCompleteFunc func(string) []string
+	completer := readline.NewPrefixCompleter()
+	names := commandNames(L)
+	for _, name := range append([]string{"help"}, builtinCommands...) {
+		if _, ok := L.GetGlobal("do_" + name).(*lua.LFunction); !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, commandName := range names {
+		if !commandAllowed(L, commandName) {
+			continue
+		}
+		autocomplete_var := L.GetGlobal("autocomplete_" + commandName)
+		if autocomplete_var.Type() != lua.LTNil {
+			autocomplete_var, ok := autocomplete_var.(*lua.LTable)
+			if !ok {
+				if !warnedAutocomplete[commandName] {
+					fmt.Println("WARNING: autocomplete variable for",
+						commandName, "must be a table. Skipping.")
+					warnedAutocomplete[commandName] = true
+				}
+				continue
+			}
+			items := []readline.PrefixCompleterInterface{}
+			// TODO - this needs to be recursive
+			autocomplete_var.ForEach(func(_, acv lua.LValue) {
+				if acv.Type() == lua.LTFunction {
+					items = append(items,
+						readline.PcItemDynamic(autocompleteFunc(L,
+							acv.(*lua.LFunction))))
+				} else {
+					items = append(items, readline.PcItem(acv.String()))
+				}
+			})
+			completer.Children = append(completer.Children,
+				readline.PcItem(commandName, items...))
+		} else {
+			completer.Children = append(completer.Children,
+				readline.PcItem(commandName))
+		}
+	}
+	return completer
+}
+
+func humanizeBytes(n float64, decimal bool) string {
+	// Formats a byte count using binary (KiB, MiB...) or decimal (kB, MB...)
+	// units
+	base := 1024.0
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	if decimal {
+		base = 1000.0
+		units = []string{"B", "kB", "MB", "GB", "TB", "PB", "EB"}
+	}
+	sign := ""
+	if n < 0 {
+		sign = "-"
+		n = -n
+	}
+	if n < base {
+		return fmt.Sprintf("%s%d %s", sign, int64(n), units[0])
+	}
+	i := 0
+	for n >= base && i < len(units)-1 {
+		n /= base
+		i++
+	}
+	return fmt.Sprintf("%s%.1f %s", sign, n, units[i])
+}
+
+func humanizeDuration(seconds float64) string {
+	// Formats a number of seconds as e.g. 2h3m, leaving out any parts that
+	// are zero. Durations under a second are shown in milliseconds.
+	sign := ""
+	if seconds < 0 {
+		sign = "-"
+		seconds = -seconds
+	}
+	if seconds < 1 {
+		return fmt.Sprintf("%s%dms", sign, int64(seconds*1000))
+	}
+	remaining := int64(seconds + 0.5)
+	out := ""
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"d", 86400}, {"h", 3600}, {"m", 60}, {"s", 1}} {
+		if remaining >= unit.size {
+			out += fmt.Sprintf("%d%s", remaining/unit.size, unit.suffix)
+			remaining %= unit.size
+		}
+	}
+	return sign + out
+}
+
+func cliHumanizeBytes(L *lua.LState) int {
+	n := float64(L.CheckNumber(1))
+	decimal := L.ToBool(2)
+	L.Push(lua.LString(humanizeBytes(n, decimal)))
+	return 1
+}
+
+func cliHumanizeDuration(L *lua.LState) int {
+	seconds := float64(L.CheckNumber(1))
+	L.Push(lua.LString(humanizeDuration(seconds)))
+	return 1
+}
+
+func newUUID(random io.Reader) string {
+	// Returns a random (version 4) UUID made from bytes read from random
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(random, b); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10],
+		b[10:])
+}
+
+// seededRandom is used instead of crypto/rand when random_seed is set, so
+// that random values can be repeated for testing
+var seededRandom *mathrand.Rand
+var randomSeed int64
+
+func randomSource(L *lua.LState) io.Reader {
+	// Returns where random values should come from
+	seed, ok := L.GetGlobal("random_seed").(lua.LNumber)
+	if !ok {
+		return rand.Reader
+	}
+	if seededRandom == nil || int64(seed) != randomSeed {
+		randomSeed = int64(seed)
+		seededRandom = mathrand.New(mathrand.NewSource(randomSeed))
+	}
+	return seededRandom
+}
+
+func cliUUID(L *lua.LState) int {
+	L.Push(lua.LString(newUUID(randomSource(L))))
+	return 1
+}
+
+func cliRandom(L *lua.LState) int {
+	// Returns a random integer from min to max, inclusive
+	min := int64(L.CheckNumber(1))
+	max := int64(L.CheckNumber(2))
+	if max < min {
+		L.ArgError(2, "max must not be less than min")
+	}
+	n, err := rand.Int(randomSource(L), big.NewInt(max-min+1))
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+	}
+	L.Push(lua.LNumber(min + n.Int64()))
+	return 1
+}
+
+func numberField(L *lua.LState, tbl *lua.LTable, key string, def float64) float64 {
+	// Returns a number from an options table, or def if it isn't set
+	if n, ok := L.GetField(tbl, key).(lua.LNumber); ok {
+		return float64(n)
+	}
+	return def
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func cliDiffTables(L *lua.LState) int {
+	// Compares two tables, going into nested tables, and returns a table
+	// with added, removed and changed tables in, keyed by the path to each
+	// value (e.g. "server.port"). Changed values are {old=..., new=...}.
+	// Also returns the differences as text, one per line, colored when
+	// writing to a terminal.
+	a := L.CheckTable(1)
+	b := L.CheckTable(2)
+	added, removed, changed := L.NewTable(), L.NewTable(), L.NewTable()
+	lines := map[string]string{}
+	show := func(v lua.LValue) string {
+		if _, ok := v.(*lua.LTable); ok {
+			value, err := luaToGo(v)
+			if err != nil {
+				return v.String()
+			}
+			out, _ := json.Marshal(value)
+			return string(out)
+		}
+		return v.String()
+	}
+	// Tables that contain themselves would be compared forever, so a pair
+	// of tables that's already being compared further up is skipped
+	type tablePair struct{ a, b *lua.LTable }
+	comparing := map[tablePair]bool{}
+	var compare func(prefix string, a, b *lua.LTable)
+	compare = func(prefix string, a, b *lua.LTable) {
+		pair := tablePair{a, b}
+		if comparing[pair] {
+			return
 		}
+		comparing[pair] = true
+		defer delete(comparing, pair)
+		a.ForEach(func(k, oldValue lua.LValue) {
+			path := prefix + k.String()
+			newValue := b.RawGet(k)
+			oldTable, oldIsTable := oldValue.(*lua.LTable)
+			newTable, newIsTable := newValue.(*lua.LTable)
+			switch {
+			case newValue == lua.LNil:
+				removed.RawSetString(path, oldValue)
+				lines[path] = colorize(L, "error", "- "+path+" = "+show(oldValue))
+			case oldIsTable && newIsTable:
+				compare(path+".", oldTable, newTable)
+			case oldValue != newValue || oldIsTable || newIsTable:
+				change := L.NewTable()
+				change.RawSetString("old", oldValue)
+				change.RawSetString("new", newValue)
+				changed.RawSetString(path, change)
+				lines[path] = colorize(L, "value",
+					"~ "+path+": "+show(oldValue)+" -> "+show(newValue))
+			}
+		})
+		b.ForEach(func(k, newValue lua.LValue) {
+			if a.RawGet(k) == lua.LNil {
+				path := prefix + k.String()
+				added.RawSetString(path, newValue)
+				lines[path] = colorize(L, "success", "+ "+path+" = "+show(newValue))
+			}
+		})
 	}
-	fmt.Printf("%s=%s\n", varname, L.GetGlobal(varname).String())
-	return 0 // Number of results
+	compare("", a, b)
+
+	paths := []string{}
+	for path := range lines {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	text := []string{}
+	for _, path := range paths {
+		text = append(text, lines[path])
+	}
+	diff := L.NewTable()
+	diff.RawSetString("added", added)
+	diff.RawSetString("removed", removed)
+	diff.RawSetString("changed", changed)
+	L.Push(diff)
+	L.Push(lua.LString(strings.Join(text, "\n")))
+	return 2
 }
 
-func cliCd(L *lua.LState) int {
-	varname := L.ToString(1)
-	value := L.ToString(2)
+func cliHTTP(L *lua.LState) int {
+	// cli_http(method, url, {headers=..., body=..., timeout=..., output=...})
+	// makes an HTTP request and returns the status code, the body and a
+	// table of the response headers. With output, the body is saved to
+	// that file, and the number of bytes written is returned in its place
+	// (the file is removed if it can't all be saved). Returns nil and an
+	// error message if the request couldn't be made. Proxies are taken from
+	// the environment, as with most tools ($HTTPS_PROXY and friends).
+	method := strings.ToUpper(L.CheckString(1))
+	url := L.CheckString(2)
+	opts := L.OptTable(3, L.NewTable())
+	if L.GetField(opts, "output") != lua.LNil {
+		checkSandbox(L, "cli_http with an output file")
+	}
+	timeout := secondsToDuration(numberField(L, opts, "timeout", 30))
+	fail := func(err error) int {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
 
-	if len(value) == 0 {
-		L.SetGlobal(varname, lua.LString("/"))
-	} else if strings.HasPrefix(value, "/") {
-		L.SetGlobal(varname, lua.LString(value))
-	} else {
-		parts := strings.Split(value, "/")
-		oldvalue := L.GetGlobal(varname).String()
-		if oldvalue == "" {
-			L.SetGlobal(varname, lua.LString("/"))
-		}
-		cwd := strings.Split(oldvalue[1:], "/")
-		if cwd[len(cwd)-1] == "" {
-			cwd = cwd[:len(cwd)-1]
+	ctx, cancel := context.WithTimeout(commandContext, timeout)
+	defer cancel()
+	var body io.Reader
+	if b, ok := L.GetField(opts, "body").(lua.LString); ok {
+		body = strings.NewReader(string(b))
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return fail(err)
+	}
+	if headers, ok := L.GetField(opts, "headers").(*lua.LTable); ok {
+		headers.ForEach(func(k, v lua.LValue) {
+			req.Header.Set(k.String(), v.String())
+		})
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fail(err)
+	}
+	defer resp.Body.Close()
+
+	var content lua.LValue
+	if filename, ok := L.GetField(opts, "output").(lua.LString); ok {
+		f, err := os.Create(string(filename))
+		if err != nil {
+			return fail(err)
 		}
-		if len(cwd) == 1 && cwd[0] == "" {
-			cwd = []string{}
+		n, err := io.Copy(f, resp.Body)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
 		}
-		for _, part := range parts {
-			if part == "." {
-				continue
-			} else if part == ".." {
-				if len(cwd) > 0 {
-					cwd = cwd[:len(cwd)-1]
-				}
-			} else {
-				cwd = append(cwd, part)
-			}
+		if err != nil {
+			os.Remove(string(filename))
+			return fail(err)
 		}
-		newvalue := "/" + strings.Join(cwd, "/")
-		if !strings.HasSuffix(newvalue, "/") {
-			newvalue = newvalue + "/"
+		content = lua.LNumber(n)
+	} else {
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return fail(err)
 		}
-		L.SetGlobal(varname, lua.LString(newvalue))
+		content = lua.LString(b)
 	}
-	fmt.Printf("%s=%s\n", varname, L.GetGlobal(varname).String())
-	return 0 // Number of results
+	headers := L.NewTable()
+	for k, v := range resp.Header {
+		headers.RawSetString(k, lua.LString(strings.Join(v, ", ")))
+	}
+	L.Push(lua.LNumber(resp.StatusCode))
+	L.Push(content)
+	L.Push(headers)
+	return 3
 }
 
-func cliEnvvar(L *lua.LState) int {
-	varname := L.ToString(1)
-	value := L.ToString(2)
-	if value != "" {
-		os.Setenv(varname, value)
+func cliWaitFor(L *lua.LState) int {
+	// Calls a function until it returns true, returning true, or until the
+	// timeout passes (or ^C is pressed), returning false
+	predicate := L.CheckFunction(1)
+	opts := L.OptTable(2, L.NewTable())
+	timeout := secondsToDuration(numberField(L, opts, "timeout", 60))
+	interval := secondsToDuration(numberField(L, opts, "interval", 2))
+
+	deadline := time.Now().Add(timeout)
+	for {
+		L.CallByParam(lua.P{
+			Fn:      predicate,
+			NRet:    1,
+			Protect: false,
+		})
+		done := lua.LVAsBool(L.Get(-1))
+		L.Pop(1)
+		if done {
+			L.Push(lua.LTrue)
+			return 1
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			L.Push(lua.LFalse)
+			return 1
+		}
+		if interval < remaining {
+			remaining = interval
+		}
+		select {
+		case <-time.After(remaining):
+		case <-commandContext.Done():
+			L.Push(lua.LFalse)
+			return 1
+		}
 	}
-	fmt.Printf("%s=%s\n", varname, os.Getenv(varname))
-	return 0 // Number of results
 }
 
-func cliToggle(L *lua.LState) int {
-	varname := L.ToString(1)
-	curr := lua.LVAsBool(L.GetGlobal(varname))
-	L.SetGlobal(varname, lua.LBool(!curr))
-	fmt.Printf("%s=%s\n", varname, L.GetGlobal(varname).String())
-	return 0 // Number of results
+// rateLimit is a token bucket for cli_ratelimit, which holds up to a second's
+// worth of calls
+type rateLimit struct {
+	tokens float64
+	last   time.Time
 }
 
-func cliEdit(L *lua.LState) int {
-	filename := L.ToString(1)
-	fileinfo, err := os.Stat(filename)
-	if err != nil {
-		fmt.Println("Error getting tempfile modtime:", err)
-		L.Push(lua.LBool(false))
+var rateLimits = map[string]*rateLimit{}
+
+func cliRatelimit(L *lua.LState) int {
+	// Waits as long as needed to keep calls with the same key under
+	// per_second calls a second. Returns false if ^C is pressed while
+	// waiting.
+	key := L.CheckString(1)
+	rate := float64(L.CheckNumber(2))
+	if rate <= 0 {
+		L.ArgError(2, "rate must be greater than 0")
+	}
+	now := time.Now()
+	limit, ok := rateLimits[key]
+	if !ok {
+		limit = &rateLimit{tokens: rate, last: now}
+		rateLimits[key] = limit
+	}
+	refill := now.Sub(limit.last).Seconds() * rate
+	limit.tokens = math.Min(rate, limit.tokens+refill)
+	limit.last = now
+	if limit.tokens >= 1 {
+		limit.tokens--
+		L.Push(lua.LTrue)
 		return 1
 	}
-	previousModtime := fileinfo.ModTime()
 
-	editor := os.Getenv("EDITOR")
-	if editor == "" {
-		editor = "vi"
+	select {
+	case <-time.After(secondsToDuration((1 - limit.tokens) / rate)):
+	case <-commandContext.Done():
+		L.Push(lua.LFalse)
+		return 1
 	}
+	limit.tokens = 0
+	limit.last = time.Now()
+	L.Push(lua.LTrue)
+	return 1
+}
 
-	c := exec.Command(editor, filename)
-	c.Stdout = os.Stdout
-	c.Stdin = os.Stdin
-	c.Stderr = os.Stderr
-	c.Run()
+func cliCached(L *lua.LState) int {
+	// Returns the result of calling a function, reusing it for ttl seconds.
+	// Results are kept in the lua registry, keyed by name.
+	key := L.CheckString(1)
+	ttl := float64(L.CheckNumber(2))
+	fn := L.CheckFunction(3)
 
-	fileinfo, err = os.Stat(filename)
-	if err != nil {
-		fmt.Println("Error getting modtime:", err)
-		L.Push(lua.LBool(false))
-		return 1
+	registry := L.Get(lua.RegistryIndex).(*lua.LTable)
+	cache, ok := L.GetField(registry, "simplecli_cache").(*lua.LTable)
+	if !ok {
+		cache = L.NewTable()
+		L.SetField(registry, "simplecli_cache", cache)
+	}
+	now := float64(time.Now().UnixNano()) / float64(time.Second)
+	if entry, ok := L.GetField(cache, key).(*lua.LTable); ok {
+		expires, _ := L.GetField(entry, "expires").(lua.LNumber)
+		if float64(expires) > now {
+			L.Push(L.GetField(entry, "value"))
+			return 1
+		}
 	}
 
-	if fileinfo.ModTime() == previousModtime {
-		fmt.Println("File was unchanged")
-		L.Push(lua.LBool(false))
+	L.CallByParam(lua.P{
+		Fn:      fn,
+		NRet:    1,
+		Protect: false,
+	})
+	entry := L.NewTable()
+	L.SetField(entry, "value", L.Get(-1))
+	L.SetField(entry, "expires", lua.LNumber(now+ttl))
+	L.SetField(cache, key, entry)
+	return 1
+}
+
+func cliExpect(L *lua.LState) int {
+	// Sends the next line the user types to a function rather than running
+	// it as a command
+	expecting = L.CheckFunction(1)
+	return 0
+}
+
+func cliTee(L *lua.LState) int {
+	// Copies the output of commands to a file as well as the terminal. Call
+	// with no filename to stop.
+	filename := L.OptString(1, "")
+	if teeFile != nil {
+		teeFile.Close()
+		teeFile = nil
+	}
+	if filename == "" {
+		return 0
+	}
+	checkSandbox(L, "cli_tee")
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		fmt.Println("Error opening tee file:", err)
+		L.Push(lua.LFalse)
 		return 1
 	}
-
-	L.Push(lua.LBool(true))
+	teeFile = f
+	L.Push(lua.LTrue)
 	return 1
 }
 
-func cliTemplateFunction(L *lua.LState, funcName string) func(io.Writer, string) (int, error) {
-	// Returns a go function that calls a lua function by name with no
-	// parameters. Used to implement calling lua functions from template
-	// strings.
-	return func(buf io.Writer, tag string) (int, error) {
-		err := L.CallByParam(lua.P{
-			Fn:      L.GetGlobal(funcName),
-			NRet:    1,
-			Protect: true,
-		})
-		if err != nil {
-			return 0, err
+func ioWrite(L *lua.LState) int {
+	// Replaces io.write, which always writes to the original stdout, with
+	// one that writes to the current stdout so that its output can be
+	// captured
+	for i := 1; i <= L.GetTop(); i++ {
+		switch v := L.Get(i).(type) {
+		case lua.LString, lua.LNumber:
+			fmt.Fprint(os.Stdout, v.String())
+		default:
+			L.ArgError(i, "string expected, got "+v.Type().String())
 		}
-		retval := L.Get(-1).String()
-		L.Pop(1)
-		return buf.Write([]byte(retval))
 	}
+	L.Push(L.GetField(L.GetGlobal("io"), "stdout"))
+	return 1
 }
 
-func cliTemplate(L *lua.LState) int {
-	templateString := L.ToString(1)
-	vars := map[string]interface{}{}
-	// First, make environment variables available in templates
-	for _, envstr := range os.Environ() {
-		parts := strings.SplitN(envstr, "=", 2)
-		vars[parts[0]] = parts[1]
-	}
-	// Next, make all lua global variables and functions available as
-	// template variables
-	globals := L.Get(lua.GlobalsIndex).(*lua.LTable)
-	globals.ForEach(func(klv lua.LValue, v lua.LValue) {
-		k := klv.String()
-		if strings.HasPrefix(k, "_") {
-			// Skip internal variables
-			return
+func parseKeyValues(text string, sep string, pairsep string) map[string]string {
+	// Parses lines of key=value pairs, as found in .env files or command
+	// output. Blank lines and lines starting with # are skipped, and values
+	// can be quoted.
+	values := map[string]string{}
+	for _, pair := range strings.Split(text, pairsep) {
+		pair = strings.TrimSpace(pair)
+		if pair == "" || strings.HasPrefix(pair, "#") {
+			continue
 		}
-		switch t := v.Type(); t {
-		case lua.LTString:
-			vars[k] = v.String()
-		case lua.LTNumber:
-			vars[k] = v.String()
-		case lua.LTBool:
-			vars[k] = v.String()
-		case lua.LTFunction:
-			vars[k] = fasttemplate.TagFunc(cliTemplateFunction(L, k))
-		case lua.LTTable:
-			// Tables are accessible with {{tblname[key]}}
-			// e.g. foo[bar] or foo[1]
-			tbl := v.(*lua.LTable)
-			tbl.ForEach(func(tblk lua.LValue, tblv lua.LValue) {
-				vars[k+"["+tblk.String()+"]"] = tblv.String()
-			})
+		parts := strings.SplitN(pair, sep, 2)
+		if len(parts) != 2 {
+			continue
 		}
-	})
-	// Add local variables too
-	debug, ok := L.GetStack(-1)
-	if ok {
-		idx := 1
-		for {
-			k, v := L.GetLocal(debug, idx)
-			if k == "" {
-				break
-			}
-			tbl, ok := v.(*lua.LTable)
-			if ok {
-				// Tables are accessible with tblname[key]
-				// e.g. foo[bar] or foo[1] or args[1]
-				tbl.ForEach(func(tblk lua.LValue, tblv lua.LValue) {
-					vars[k+"["+tblk.String()+"]"] = tblv.String()
-				})
-			} else {
-				vars[k] = v.String()
+		key := strings.TrimSpace(strings.TrimPrefix(parts[0], "export "))
+		value := strings.TrimSpace(parts[1])
+		if len(value) >= 2 {
+			switch {
+			case value[0] == '"' && value[len(value)-1] == '"':
+				if unquoted, err := strconv.Unquote(value); err == nil {
+					value = unquoted
+				}
+			case value[0] == '\'' && value[len(value)-1] == '\'':
+				value = value[1 : len(value)-1]
 			}
-			idx++
 		}
+		values[key] = value
 	}
+	return values
+}
 
-	t, err := fasttemplate.NewTemplate(templateString, "{{", "}}")
-	if err != nil {
-		fmt.Println(err.Error())
-		return 0
+func cliParseKv(L *lua.LState) int {
+	text := L.CheckString(1)
+	opts := L.OptTable(2, L.NewTable())
+	sep := "="
+	if v, ok := L.GetField(opts, "sep").(lua.LString); ok && v != "" {
+		sep = string(v)
 	}
-	L.Push(lua.LString(t.ExecuteString(vars)))
+	pairsep := "\n"
+	if v, ok := L.GetField(opts, "pairsep").(lua.LString); ok && v != "" {
+		pairsep = string(v)
+	}
+	result := L.NewTable()
+	for k, v := range parseKeyValues(text, sep, pairsep) {
+		L.SetField(result, k, lua.LString(v))
+	}
+	L.Push(result)
 	return 1
 }
 
-func autocompleteFunc(L *lua.LState, funcobj *lua.LFunction) func(string) []string {
-	// Returns a go function that calls a lua autocomplete function by name.
-	return func(line string) []string {
-		err := L.CallByParam(lua.P{
-			Fn:      funcobj,
-			NRet:    1,
-			Protect: true,
-		}, lua.LString(line))
+func cliCsv(L *lua.LState) int {
+	// cli_csv(rows, {headers=..., delimiter=..., file=...}) writes rows as
+	// CSV to stdout, or to a file. Rows can be lists of values, or tables
+	// of column name to value, in which case headers picks the columns (all
+	// of them, sorted, if it isn't given).
+	rows := L.CheckTable(1)
+	opts := L.OptTable(2, L.NewTable())
+	headers := []string{}
+	if t, ok := L.GetField(opts, "headers").(*lua.LTable); ok {
+		t.ForEach(func(_, v lua.LValue) {
+			headers = append(headers, v.String())
+		})
+	}
+	keyed := false
+	if first, ok := rows.RawGetInt(1).(*lua.LTable); ok && first.Len() == 0 {
+		keyed = true
+	}
+	if keyed && len(headers) == 0 {
+		seen := map[string]bool{}
+		rows.ForEach(func(_, row lua.LValue) {
+			if t, ok := row.(*lua.LTable); ok {
+				t.ForEach(func(k, _ lua.LValue) {
+					if !seen[k.String()] {
+						seen[k.String()] = true
+						headers = append(headers, k.String())
+					}
+				})
+			}
+		})
+		sort.Strings(headers)
+	}
+
+	out := io.Writer(os.Stdout)
+	if filename, ok := L.GetField(opts, "file").(lua.LString); ok {
+		checkSandbox(L, "cli_csv with a file")
+		f, err := os.Create(string(filename))
 		if err != nil {
-			return []string{}
+			L.RaiseError("can't write csv: %s", err)
 		}
-		retval, ok := L.Get(-1).(*lua.LTable)
-		L.Pop(1)
+		defer f.Close()
+		out = f
+	}
+	w := csv.NewWriter(out)
+	if d, ok := L.GetField(opts, "delimiter").(lua.LString); ok {
+		r := []rune(string(d))
+		if len(r) != 1 {
+			L.ArgError(2, "delimiter must be a single character")
+		}
+		w.Comma = r[0]
+	}
+	if len(headers) > 0 {
+		w.Write(headers)
+	}
+	for i := 1; i <= rows.Len(); i++ {
+		row, ok := rows.RawGetInt(i).(*lua.LTable)
 		if !ok {
-			fmt.Println("Autocomplete error: function didn't return a table")
-			return []string{}
+			L.ArgError(1, fmt.Sprintf("row %d isn't a table", i))
 		}
-		items := []string{}
-		retval.ForEach(func(klv lua.LValue, v lua.LValue) {
-			items = append(items, v.String())
-		})
-		return items
+		record := []string{}
+		if keyed {
+			for _, h := range headers {
+				if v := row.RawGetString(h); v != lua.LNil {
+					record = append(record, v.String())
+				} else {
+					record = append(record, "")
+				}
+			}
+		} else {
+			for j := 1; j <= row.Len(); j++ {
+				record = append(record, row.RawGetInt(j).String())
+			}
+		}
+		w.Write(record)
 	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		L.RaiseError("can't write csv: %s", err)
+	}
+	return 0
 }
 
-func setupAutocomplete(rl *readline.Instance, L *lua.LState) {
-	completer := readline.NewPrefixCompleter()
-	rl.Config.AutoComplete = completer
-	// With children: readline.PcItem("test", readline.PcItem("foo"))
-	// Dynamic: readline.PcItemDynamic(someFunction("foo"), children...)
-	// type DynamicCompleteFunc func(string) []string
-	globals := L.Get(lua.GlobalsIndex).(*lua.LTable)
-	globals.ForEach(func(klv lua.LValue, v lua.LValue) {
-		k := klv.String()
-		if strings.HasPrefix(k, "do_") {
-			commandName := k[3:]
-			autocomplete_var := L.GetGlobal("autocomplete_" + commandName)
-			if autocomplete_var.Type() != lua.LTNil {
-				autocomplete_var, ok := autocomplete_var.(*lua.LTable)
-				if !ok {
-					fmt.Println("WARNING: autocomplete variable for",
-						commandName, "must be a table. Skipping.")
-					return
-				}
-				items := []readline.PrefixCompleterInterface{}
-				// TODO - this needs to be recursive
-				autocomplete_var.ForEach(func(_, acv lua.LValue) {
-					if acv.Type() == lua.LTFunction {
-						items = append(items,
-							readline.PcItemDynamic(autocompleteFunc(L,
-								acv.(*lua.LFunction))))
-					} else {
-						items = append(items, readline.PcItem(acv.String()))
-					}
-				})
-				completer.Children = append(completer.Children,
-					readline.PcItem(commandName, items...))
-			} else {
-				completer.Children = append(completer.Children,
-					readline.PcItem(commandName))
-			}
+func cliArgspec(L *lua.LState) int {
+	// Returns the argspec table for a command, or nil if it has none
+	if spec := argspec(L, L.CheckString(1)); spec != nil {
+		L.Push(spec)
+	} else {
+		L.Push(lua.LNil)
+	}
+	return 1
+}
+
+// assertionFailed is raised by cli_assert, so that failed assertions can be
+// told apart from other errors
+type assertionFailed struct {
+	message string
+}
+
+func assertionMessage(err error) (string, bool) {
+	var apiErr *lua.ApiError
+	if !errors.As(err, &apiErr) {
+		return "", false
+	}
+	if ud, ok := apiErr.Object.(*lua.LUserData); ok {
+		if a, ok := ud.Value.(assertionFailed); ok {
+			return a.message, true
 		}
-	})
+	}
+	return "", false
+}
+
+func cliAssert(L *lua.LState) int {
+	// Raises an error with the message if the condition is false or nil
+	if lua.LVAsBool(L.Get(1)) {
+		return 0
+	}
+	message := L.OptString(2, "assertion failed")
+	ud := L.NewUserData()
+	ud.Value = assertionFailed{message}
+	// So that pcall and friends see the message rather than "userdata: ..."
+	mt := L.NewTable()
+	L.SetField(mt, "__tostring", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(message))
+		return 1
+	}))
+	L.SetMetatable(ud, mt)
+	L.Error(ud, 0)
+	return 0
 }
 
 func registerLuaFunctions(L *lua.LState) {
 	L.SetGlobal("cli_variable", L.NewFunction(cliVariable))
 	L.SetGlobal("cli_cd", L.NewFunction(cliCd))
+	L.SetGlobal("cli_pushd", L.NewFunction(cliPushd))
+	L.SetGlobal("cli_popd", L.NewFunction(cliPopd))
 	L.SetGlobal("cli_envvar", L.NewFunction(cliEnvvar))
+	L.SetGlobal("cli_with_env", L.NewFunction(cliWithEnv))
+	L.SetGlobal("cli_transaction", L.NewFunction(cliTransaction))
+	L.SetGlobal("cli_defer", L.NewFunction(cliDefer))
 	L.SetGlobal("cli_toggle", L.NewFunction(cliToggle))
 	L.SetGlobal("cli_edit", L.NewFunction(cliEdit))
+	L.SetGlobal("cli_shell", L.NewFunction(cliShell))
+	L.SetGlobal("cli_exec", L.NewFunction(cliExec))
+	L.SetGlobal("cli_credential", L.NewFunction(cliCredential))
+	L.SetGlobal("cli_exec_stream", L.NewFunction(cliExecStream))
 	L.SetGlobal("t", L.NewFunction(cliTemplate))
+	L.SetGlobal("cli_template_file", L.NewFunction(cliTemplateFile))
+	L.SetGlobal("cli_humanize_bytes", L.NewFunction(cliHumanizeBytes))
+	L.SetGlobal("cli_humanize_duration", L.NewFunction(cliHumanizeDuration))
+	L.SetGlobal("cli_uuid", L.NewFunction(cliUUID))
+	L.SetGlobal("cli_random", L.NewFunction(cliRandom))
+	L.SetGlobal("cli_wait_for", L.NewFunction(cliWaitFor))
+	L.SetGlobal("cli_cached", L.NewFunction(cliCached))
+	L.SetGlobal("cli_ratelimit", L.NewFunction(cliRatelimit))
+	L.SetGlobal("cli_expect", L.NewFunction(cliExpect))
+	L.SetGlobal("cli_tee", L.NewFunction(cliTee))
+	L.SetGlobal("cli_parse_kv", L.NewFunction(cliParseKv))
+	L.SetGlobal("cli_prompt_dirty", L.NewFunction(cliPromptDirty))
+	L.SetGlobal("cli_prompt", L.NewFunction(cliPrompt))
+	L.SetGlobal("cli_prompt_number", L.NewFunction(cliPromptNumber))
+	L.SetGlobal("cli_confirm", L.NewFunction(cliConfirm))
+	L.SetGlobal("cli_prefill", L.NewFunction(cliPrefill))
+	L.SetGlobal("cli_argspec", L.NewFunction(cliArgspec))
+	L.SetGlobal("cli_kv", L.NewFunction(cliKv))
+	L.SetGlobal("cli_csv", L.NewFunction(cliCsv))
+	L.SetGlobal("cli_print", L.NewFunction(cliPrint))
+	L.SetGlobal("cli_format", L.NewFunction(cliFormat))
+	L.SetGlobal("cli_json", L.NewFunction(cliJSON))
+	L.SetGlobal("cli_diff_tables", L.NewFunction(cliDiffTables))
+	L.SetGlobal("cli_http", L.NewFunction(cliHTTP))
+	L.SetGlobal("cli_assert", L.NewFunction(cliAssert))
+	L.SetGlobal("cli_last_error", L.NewFunction(cliLastError))
+	L.SetGlobal("cli_history", L.NewFunction(cliHistory))
+	L.SetGlobal("cli_commands", L.NewFunction(cliCommands))
+	L.SetGlobal("cli_config", L.NewFunction(cliConfig))
+	L.SetGlobal("cli_color", L.NewFunction(cliColor))
+	if io, ok := L.GetGlobal("io").(*lua.LTable); ok {
+		L.SetField(io, "write", L.NewFunction(ioWrite))
+	}
 }
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Printf("Usage: %s CONFIGFILE [OPTIONS]\n", os.Args[0])
+		fmt.Printf("Usage: %s CONFIGFILE [OPTIONS] [COMMAND [ARGS...]]\n",
+			os.Args[0])
 		os.Exit(1)
 	}
 	luaFile := os.Args[1]
 	os.Args = append(os.Args[:1], os.Args[2:]...)
-	Run(luaFile)
+	os.Exit(Run(luaFile))
 }
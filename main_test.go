@@ -0,0 +1,741 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/shlex"
+	"github.com/yuin/gopher-lua"
+)
+
+func newTestState(t *testing.T, code string) *lua.LState {
+	// Makes a lua state with the cli_ helpers, and runs code in it
+	t.Helper()
+	L := newLuaState()
+	t.Cleanup(L.Close)
+	registerLuaFunctions(L)
+	if err := L.DoString(code); err != nil {
+		t.Fatal(err)
+	}
+	return L
+}
+
+func output(fn func()) string {
+	buf := &bytes.Buffer{}
+	captureOutput(buf, fn)
+	return buf.String()
+}
+
+func TestHumanizeBytes(t *testing.T) {
+	tests := []struct {
+		n       float64
+		decimal bool
+		want    string
+	}{
+		{0, false, "0 B"},
+		{1023, false, "1023 B"},
+		{1024, false, "1.0 KiB"},
+		{1536, false, "1.5 KiB"},
+		{1.5 * 1024 * 1024 * 1024, false, "1.5 GiB"},
+		{-2048, false, "-2.0 KiB"},
+		{999, true, "999 B"},
+		{1500, true, "1.5 kB"},
+		{2500000, true, "2.5 MB"},
+		{1 << 62, false, "4.0 EiB"},
+		{1e30, true, "1000000000000.0 EB"},
+	}
+	for _, test := range tests {
+		if got := humanizeBytes(test.n, test.decimal); got != test.want {
+			t.Errorf("humanizeBytes(%g, %v) = %q, want %q", test.n,
+				test.decimal, got, test.want)
+		}
+	}
+}
+
+func TestHumanizeDuration(t *testing.T) {
+	tests := []struct {
+		seconds float64
+		want    string
+	}{
+		{0, "0ms"},
+		{0.25, "250ms"},
+		{1, "1s"},
+		{59.6, "1m"},
+		{7380, "2h3m"},
+		{90061, "1d1h1m1s"},
+		{86400, "1d"},
+		{-60, "-1m"},
+	}
+	for _, test := range tests {
+		if got := humanizeDuration(test.seconds); got != test.want {
+			t.Errorf("humanizeDuration(%g) = %q, want %q", test.seconds, got,
+				test.want)
+		}
+	}
+}
+
+func TestParseKeyValues(t *testing.T) {
+	tests := []struct {
+		text, sep, pairsep string
+		want               map[string]string
+	}{
+		{"A=1\nB=2\n", "=", "\n", map[string]string{"A": "1", "B": "2"}},
+		{"# comment\n\nexport A = x\nnovalue\n", "=", "\n",
+			map[string]string{"A": "x"}},
+		{`A="x y\n"` + "\nB='it is'\nC=a=b", "=", "\n",
+			map[string]string{"A": "x y\n", "B": "it is", "C": "a=b"}},
+		{"a: 1; b: 2", ":", ";", map[string]string{"a": "1", "b": "2"}},
+		{`A="`, "=", "\n", map[string]string{"A": `"`}},
+	}
+	for _, test := range tests {
+		got := parseKeyValues(test.text, test.sep, test.pairsep)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseKeyValues(%q) = %v, want %v", test.text, got,
+				test.want)
+		}
+	}
+}
+
+func TestShellJoin(t *testing.T) {
+	// Joined arguments have to split back up the same way, and not be taken
+	// as anything other than arguments when the line is parsed again
+	args := []string{"plain", "", "two words", "it's", `a"b`, `back\slash`,
+		"#hash", "a;other", "x&&y", "a|b", ">", ">>", "<", "{a=1}", "$HOME"}
+	line := shellJoin(args)
+	got, err := shlex.Split(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, args) {
+		t.Errorf("shlex.Split(shellJoin(args)) = %q, want %q", got, args)
+	}
+	if commands, _ := splitChain(line); len(commands) != 1 {
+		t.Errorf("splitChain(%q) split the line into %q", line, commands)
+	}
+	if _, filename, _ := splitRedirect(line); filename != "" {
+		t.Errorf("splitRedirect(%q) found a redirect to %q", line, filename)
+	}
+	if _, stages := splitPipeline(line); len(stages) != 0 {
+		t.Errorf("splitPipeline(%q) found a pipe to %q", line, stages)
+	}
+}
+
+func TestSplitChain(t *testing.T) {
+	tests := []struct {
+		line      string
+		commands  []string
+		operators []string
+	}{
+		{"ls", []string{"ls"}, []string{}},
+		{"a; b", []string{"a", " b"}, []string{";"}},
+		{"a && b || c", []string{"a ", " b ", " c"}, []string{"&&", "||"}},
+		{"a & b | c", []string{"a & b | c"}, []string{}},
+		{`say "a;b" 'c && d'`, []string{`say "a;b" 'c && d'`}, []string{}},
+		{`say a\;b`, []string{`say a\;b`}, []string{}},
+		{"deploy {a=1; b=2}; status", []string{"deploy {a=1; b=2}", " status"},
+			[]string{";"}},
+		// Comments aren't split up
+		{"echo hi # note; other", []string{"echo hi # note; other"},
+			[]string{}},
+		{"echo a#b; other", []string{"echo a#b", " other"}, []string{";"}},
+		// A { that's never closed isn't an options table
+		{"echo { ; other", []string{"echo { ", " other"}, []string{";"}},
+		{"echo } ; other", []string{"echo } ", " other"}, []string{";"}},
+	}
+	for _, test := range tests {
+		commands, operators := splitChain(test.line)
+		if !reflect.DeepEqual(commands, test.commands) ||
+			!reflect.DeepEqual(operators, test.operators) {
+			t.Errorf("splitChain(%q) = %q, %q, want %q, %q", test.line,
+				commands, operators, test.commands, test.operators)
+		}
+	}
+}
+
+func TestSplitRedirect(t *testing.T) {
+	tests := []struct {
+		line, command, filename string
+		appending               bool
+	}{
+		{"ls", "ls", "", false},
+		{"ls > out.txt", "ls", "out.txt", false},
+		{"ls >> out.txt", "ls", "out.txt", true},
+		{`ls > "my file"`, "ls", "my file", false},
+		{"ls > a b", "ls > a b", "", false},
+		{"ls a>b", "ls a>b", "", false},
+		{`say ">note"`, `say ">note"`, "", false},
+		{`say '>' note`, `say '>' note`, "", false},
+		{"say a > b > c", "say a > b", "c", false},
+		{"ls # > out", "ls # > out", "", false},
+		{"deploy {a='>'} > out", "deploy {a='>'}", "out", false},
+	}
+	for _, test := range tests {
+		command, filename, appending := splitRedirect(test.line)
+		if command != test.command || filename != test.filename ||
+			appending != test.appending {
+			t.Errorf("splitRedirect(%q) = %q, %q, %v, want %q, %q, %v",
+				test.line, command, filename, appending, test.command,
+				test.filename, test.appending)
+		}
+	}
+}
+
+func TestSplitPipeline(t *testing.T) {
+	tests := []struct {
+		line, command string
+		stages        []string
+	}{
+		{"ls", "ls", nil},
+		{"ls | grep x", "ls", []string{" grep x"}},
+		{"ls | sort | uniq -c", "ls", []string{" sort ", " uniq -c"}},
+		{`say "|" x`, `say "|" x`, nil},
+		{"say a|b", "say a|b", nil},
+		{"a || b", "a || b", nil},
+		{"ls # | grep", "ls # | grep", nil},
+	}
+	for _, test := range tests {
+		command, stages := splitPipeline(test.line)
+		if len(stages) == 0 {
+			stages = nil
+		}
+		if command != test.command || !reflect.DeepEqual(stages, test.stages) {
+			t.Errorf("splitPipeline(%q) = %q, %q, want %q, %q", test.line,
+				command, stages, test.command, test.stages)
+		}
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("NAME", "world")
+	t.Setenv("SPACES", "a b")
+	t.Setenv("QUOTE", `it's "x"`)
+	t.Setenv("REDIRECT", ">/tmp/file")
+	t.Setenv("CHAIN", "a; other")
+	t.Setenv("EMPTY", "")
+	os.Unsetenv("UNSET_FOR_TEST")
+	tests := []struct {
+		line        string
+		keepUnknown bool
+		want        string
+	}{
+		{"say $NAME", false, "say 'world'"},
+		{"say ${NAME}!", false, "say 'world'!"},
+		{`say "$NAME"`, false, `say "world"`},
+		{"say '$NAME'", false, "say '$NAME'"},
+		{`say \$NAME`, false, `say \$NAME`},
+		{"say $SPACES", false, "say 'a b'"},
+		{"say $QUOTE", false, `say 'it'"'"'s "x"'`},
+		{`say "$QUOTE"`, false, `say "it's \"x\""`},
+		{"say $REDIRECT", false, "say '>/tmp/file'"},
+		{"say $CHAIN", false, "say 'a; other'"},
+		{"say $EMPTY.", false, "say ."},
+		{"say $UNSET_FOR_TEST", false, "say "},
+		{"say $UNSET_FOR_TEST", true, "say '$UNSET_FOR_TEST'"},
+		{"say $_ $", false, "say $_ $"},
+	}
+	for _, test := range tests {
+		if got := expandEnv(test.line, test.keepUnknown); got != test.want {
+			t.Errorf("expandEnv(%q, %v) = %q, want %q", test.line,
+				test.keepUnknown, got, test.want)
+		}
+	}
+	// An expanded value can't turn into a redirect
+	if _, filename, _ := splitRedirect(expandEnv("say $REDIRECT",
+		false)); filename != "" {
+		t.Errorf("expanded variable was taken as a redirect to %q", filename)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		a, b, want []string
+	}{
+		{[]string{"a", "b"}, []string{"a", "b"}, nil},
+		{[]string{}, []string{}, nil},
+		{[]string{"a", "b"}, []string{"a", "c"}, []string{" a", "-b", "+c"}},
+		{[]string{"a"}, []string{"a", "b"}, []string{" a", "+b"}},
+		{[]string{"x", "a", "b"}, []string{"a", "b", "y"},
+			[]string{"-x", " a", " b", "+y"}},
+	}
+	for _, test := range tests {
+		if got := diffLines(test.a, test.b); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("diffLines(%q, %q) = %q, want %q", test.a, test.b, got,
+				test.want)
+		}
+	}
+}
+
+func TestCommonPrefix(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   string
+	}{
+		{nil, ""},
+		{[]string{"alpha"}, "alpha"},
+		{[]string{"alpha", "alps"}, "alp"},
+		{[]string{"alpha", "beta"}, ""},
+		// é and è share their first byte, which mustn't be kept on its own
+		{[]string{"café", "cafè"}, "caf"},
+		{[]string{"日本語", "日本"}, "日本"},
+	}
+	for _, test := range tests {
+		if got := commonPrefix(test.values); got != test.want {
+			t.Errorf("commonPrefix(%q) = %q, want %q", test.values, got,
+				test.want)
+		}
+	}
+}
+
+func TestLuaToGo(t *testing.T) {
+	L := newTestState(t, `
+		list = {1, "two", true}
+		obj = {name = "x", nested = {a = {1, 2}}}
+		loop = {}
+		loop.self = loop
+		shared = {}
+		twice = {a = shared, b = shared}
+	`)
+	tests := []struct {
+		name string
+		want interface{}
+	}{
+		{"list", []interface{}{1.0, "two", true}},
+		{"obj", map[string]interface{}{"name": "x",
+			"nested": map[string]interface{}{"a": []interface{}{1.0, 2.0}}}},
+		{"twice", map[string]interface{}{"a": map[string]interface{}{},
+			"b": map[string]interface{}{}}},
+	}
+	for _, test := range tests {
+		got, err := luaToGo(L.GetGlobal(test.name))
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("luaToGo(%s) = %#v, %v, want %#v", test.name, got, err,
+				test.want)
+		}
+	}
+	if _, err := luaToGo(L.GetGlobal("loop")); err == nil {
+		t.Error("luaToGo of a table that contains itself didn't fail")
+	}
+}
+
+func TestCliDiffTablesCycle(t *testing.T) {
+	// Tables that contain themselves are compared without looping forever
+	L := newTestState(t, `
+		a = {x = 1}
+		a.self = a
+		b = {x = 2}
+		b.self = b
+		diff = cli_diff_tables(a, b)
+	`)
+	diff := L.GetGlobal("diff").(*lua.LTable)
+	changed := L.GetField(diff, "changed").(*lua.LTable)
+	if L.GetField(changed, "x") == lua.LNil {
+		t.Error("cli_diff_tables didn't find the changed value")
+	}
+}
+
+func TestCliCsvRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	rows := [][]string{
+		{"plain", "with,comma", `with "quotes"`},
+		{"new\nline", " spaces ", ""},
+		{"tab\there", "'single'", "ünïcode"},
+	}
+	for _, delimiter := range []rune{',', '\t', ';'} {
+		file := filepath.Join(dir, "out.csv")
+		L := newTestState(t, `
+			function write(file, delimiter)
+				cli_csv({
+					{"plain", "with,comma", 'with "quotes"'},
+					{"new\nline", " spaces ", ""},
+					{"tab\there", "'single'", "ünïcode"},
+				}, {file = file, delimiter = delimiter})
+			end
+		`)
+		if err := L.CallByParam(lua.P{Fn: L.GetGlobal("write"), Protect: true},
+			lua.LString(file), lua.LString(string(delimiter))); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := csv.NewReader(f)
+		r.Comma = delimiter
+		got, err := r.ReadAll()
+		f.Close()
+		if err != nil {
+			t.Fatalf("reading back %q csv: %s", delimiter, err)
+		}
+		if !reflect.DeepEqual(got, rows) {
+			t.Errorf("%q csv read back as %q, want %q", delimiter, got, rows)
+		}
+	}
+}
+
+func TestCliCsvHeaders(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "out.csv")
+	L := newTestState(t, `
+		function write(file, headers)
+			cli_csv({{name = "a", size = 1}, {name = "b"}},
+				{file = file, headers = headers})
+		end
+	`)
+	tests := []struct {
+		headers lua.LValue
+		want    string
+	}{
+		{lua.LNil, "name,size\na,1\nb,\n"},
+		{L.NewTable(), "name,size\na,1\nb,\n"},
+	}
+	headers := L.NewTable()
+	headers.Append(lua.LString("size"))
+	tests = append(tests, struct {
+		headers lua.LValue
+		want    string
+	}{headers, "size\n1\n\n"})
+	for _, test := range tests {
+		if err := L.CallByParam(lua.P{Fn: L.GetGlobal("write"), Protect: true},
+			lua.LString(file), test.headers); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != test.want {
+			t.Errorf("cli_csv with headers %v wrote %q, want %q", test.headers,
+				got, test.want)
+		}
+	}
+}
+
+func TestCliFormat(t *testing.T) {
+	L := newTestState(t, "")
+	tests := []struct {
+		code string
+		want string
+	}{
+		{`cli_format("%d %x %o", 42, 255, 8)`, "42 ff 10"},
+		{`cli_format("%d", 2.9)`, "2"},
+		{`cli_format("%.2f %g %e", 1.5, 0.25, 1000)`,
+			"1.50 0.25 1.000000e+03"},
+		{`cli_format("%v %s", 3, 1.5)`, "3 1.5"},
+		{`cli_format("%5d|%-5s|%5.1f", 7, "ab", 2.25)`, "    7|ab   |  2.2"},
+		{`cli_format("%s %q", "x", "y")`, `x "y"`},
+		{`cli_format("%t %v", true, false)`, "true false"},
+		{`cli_format("%v", nil)`, "nil"},
+		{`cli_format("%v", {1, 2})`, "[1,2]"},
+		{`cli_format("%v", {a = 1})`, `{"a":1}`},
+		{`cli_format("%+v", {a = 1})`, "{\n  \"a\": 1\n}"},
+		{`cli_format("%12v|", {1})`, "         [1]|"},
+		{`cli_format("%d%%", 50)`, "50%"},
+	}
+	for _, test := range tests {
+		if err := L.DoString("result = " + test.code); err != nil {
+			t.Errorf("%s: %s", test.code, err)
+			continue
+		}
+		if got := L.GetGlobal("result").String(); got != test.want {
+			t.Errorf("%s = %q, want %q", test.code, got, test.want)
+		}
+	}
+	if err := L.DoString(`t = {} t.t = t cli_format("%v", t)`); err == nil {
+		t.Error("cli_format of a table that contains itself didn't fail")
+	}
+}
+
+func TestCliTransaction(t *testing.T) {
+	// A deploy that fails verification is rolled back, most recent step
+	// first, and the error is raised again
+	L := newTestState(t, `
+		steps = {}
+		function step(name)
+			table.insert(steps, name)
+			cli_defer(function() table.insert(steps, "undo " .. name) end)
+		end
+		function deploy(verified)
+			return cli_transaction(function()
+				step("deploy")
+				step("switch traffic")
+				if not verified then
+					error("verification failed")
+				end
+				return "deployed"
+			end)
+		end
+	`)
+	tests := []struct {
+		verified bool
+		steps    string
+		err      string
+	}{
+		{true, "deploy,switch traffic", ""},
+		{false, "deploy,switch traffic,undo switch traffic,undo deploy",
+			"verification failed"},
+	}
+	for _, test := range tests {
+		L.SetGlobal("steps", L.NewTable())
+		err := L.CallByParam(lua.P{Fn: L.GetGlobal("deploy"), NRet: 1,
+			Protect: true}, lua.LBool(test.verified))
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("verified deploy failed: %s", err)
+			} else if got := L.Get(-1).String(); got != "deployed" {
+				t.Errorf("verified deploy returned %q", got)
+			}
+			L.Pop(1)
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("unverified deploy raised %v, want %q", err, test.err)
+		}
+		steps := []string{}
+		L.GetGlobal("steps").(*lua.LTable).ForEach(func(_, v lua.LValue) {
+			steps = append(steps, v.String())
+		})
+		if got := strings.Join(steps, ","); got != test.steps {
+			t.Errorf("deploy(%v) steps = %q, want %q", test.verified, got,
+				test.steps)
+		}
+	}
+	if err := L.DoString(`cli_defer(function() end)`); err == nil {
+		t.Error("cli_defer outside a transaction didn't fail")
+	}
+}
+
+func TestSandboxRequested(t *testing.T) {
+	args := os.Args
+	defer func() { os.Args = args }()
+	tests := []struct {
+		args []string
+		want bool
+	}{
+		{[]string{}, false},
+		{[]string{"--sandbox"}, true},
+		{[]string{"-sandbox"}, true},
+		{[]string{"--sandbox=true"}, true},
+		{[]string{"--sandbox=1"}, true},
+		{[]string{"--sandbox=t"}, true},
+		{[]string{"-sandbox=TRUE"}, true},
+		{[]string{"--sandbox=false"}, false},
+		{[]string{"--sandbox=0"}, false},
+		{[]string{"--sandbox", "--sandbox=false"}, false},
+		{[]string{"--sandboxed"}, false},
+		{[]string{"--", "--sandbox"}, false},
+	}
+	for _, test := range tests {
+		os.Args = append([]string{"simplecli"}, test.args...)
+		if got := sandboxRequested(); got != test.want {
+			t.Errorf("sandboxRequested() with %q = %v, want %v", test.args,
+				got, test.want)
+		}
+	}
+}
+
+func TestSandboxLibraries(t *testing.T) {
+	args := os.Args
+	defer func() { os.Args = args }()
+	os.Args = []string{"simplecli", "--sandbox=1"}
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SIMPLECLI_HISTORY_FILE", "")
+	L := newTestState(t, `
+		function kinds(names)
+			local result = {}
+			for _, name in ipairs(names) do
+				table.insert(result, type(_G[name]))
+			end
+			return table.concat(result, ",")
+		end
+	`)
+	tests := []struct {
+		names []string
+		want  string
+	}{
+		// Removed
+		{[]string{"os", "io", "debug", "package"}, "nil,nil,nil,nil"},
+		{[]string{"dofile", "loadfile", "require", "module"},
+			"nil,nil,nil,nil"},
+		// Still available
+		{[]string{"table", "string", "math", "coroutine"},
+			"table,table,table,table"},
+		{[]string{"print", "pairs", "cli_format"},
+			"function,function,function"},
+	}
+	for _, test := range tests {
+		names := L.NewTable()
+		for _, name := range test.names {
+			names.Append(lua.LString(name))
+		}
+		if err := L.CallByParam(lua.P{Fn: L.GetGlobal("kinds"), NRet: 1,
+			Protect: true}, names); err != nil {
+			t.Fatal(err)
+		}
+		if got := L.Get(-1).String(); got != test.want {
+			t.Errorf("types of %q = %q, want %q", test.names, got, test.want)
+		}
+		L.Pop(1)
+	}
+
+	// The helpers that use files or run programs raise an error
+	for _, code := range []string{
+		`cli_shell("true")`,
+		`cli_exec("true")`,
+		`cli_template_file("/etc/hostname")`,
+		`cli_csv({{"a"}}, {file = "/tmp/sandboxed.csv"})`,
+		`cli_http("GET", "http://127.0.0.1:1", {output = "/tmp/sandboxed"})`,
+	} {
+		err := L.DoString(code)
+		if err == nil || !strings.Contains(err.Error(), "--sandbox") {
+			t.Errorf("%s under --sandbox gave %v", code, err)
+		}
+	}
+
+	// Settings that would read or write files are ignored
+	L.SetGlobal("prompt_file", lua.LString("/etc/hostname"))
+	if _, ok := renderGlobalTemplateFile(L, "prompt_file"); ok {
+		t.Error("prompt_file was read under --sandbox")
+	}
+	L.SetGlobal("state_file", lua.LString("/tmp/victim"))
+	if got := stateFile(L); got != "" {
+		t.Errorf("state_file under --sandbox gave %q", got)
+	}
+	L.SetGlobal("history_file", lua.LString("/tmp/victim"))
+	if got := historyFile(L, "test.lua"); got == "/tmp/victim" {
+		t.Error("history_file was used under --sandbox")
+	}
+}
+
+func TestCompletionOffsets(t *testing.T) {
+	// readline takes the offset as a number of runes
+	L := newTestState(t, `
+		function complete_x(args, partial)
+			return {"éa", "éb", "other"}
+		end
+		function complete_y(args, partial)
+			return {"日本語"}
+		end
+		function list_z(dir)
+			return {"über/", "übel"}
+		end
+	`)
+	c := &luaCompleter{L: L}
+	tests := []struct {
+		fn, text string
+		items    []string
+		offset   int
+	}{
+		{"complete_x", "x é", []string{"a", "b"}, 1},
+		{"complete_y", "y 日本", []string{"語 "}, 2},
+		{"complete_x", "x ", []string{"éa", "éb", "other"}, 0},
+		{"list_z", "z üb", []string{"er/", "el"}, 2},
+		{"list_z", "z übe", []string{"r/", "l"}, 3},
+	}
+	for _, test := range tests {
+		fn := L.GetGlobal(test.fn).(*lua.LFunction)
+		var items [][]rune
+		var offset int
+		if strings.HasPrefix(test.fn, "list_") {
+			items, offset = c.completePath(fn, test.text)
+		} else {
+			items, offset = c.complete(fn, test.text)
+		}
+		got := []string{}
+		for _, item := range items {
+			got = append(got, string(item))
+		}
+		if !reflect.DeepEqual(got, test.items) || offset != test.offset {
+			t.Errorf("completing %q = %q, %d, want %q, %d", test.text, got,
+				offset, test.items, test.offset)
+		}
+	}
+}
+
+func TestMatchPrefixUnicode(t *testing.T) {
+	L := newTestState(t, `
+		_G["do_café"] = function() end
+		_G["do_cafè"] = function() end
+		_G["do_日本"] = function() end
+	`)
+	// Only ambiguous prefixes return the commands they could be
+	tests := []struct {
+		cmd, want string
+		matches   int
+	}{
+		{"café", "café", 0},
+		{"日", "日本", 0},
+		{"caf", "caf", 2},
+	}
+	for _, test := range tests {
+		got, matches := matchPrefix(L, test.cmd)
+		if got != test.want || len(matches) != test.matches {
+			t.Errorf("matchPrefix(%q) = %q, %q, want %q with %d matches",
+				test.cmd, got, matches, test.want, test.matches)
+		}
+	}
+}
+
+func TestAllowedCommandsGateOutput(t *testing.T) {
+	// With an allowed list, a command that isn't allowed can't start the
+	// programs it's piped to or open the file it's redirected to, and pipes
+	// and redirects need "|" and ">" in the list
+	dir := t.TempDir()
+	L := newTestState(t, `function do_status() print("fine") end`)
+	defer func(value string) { *allow = value }(*allow)
+	tests := []struct {
+		allow, line string
+		created     bool
+	}{
+		{"status", "nosuch | sh -c 'touch " + dir + "/piped'", false},
+		{"status", "status | sh -c 'touch " + dir + "/piped'", false},
+		{"status", "nosuch > " + dir + "/redirected", false},
+		{"status", "status > " + dir + "/redirected", false},
+		{"status,|", "status | sh -c 'cat > " + dir + "/piped'", true},
+		{"status,>", "status > " + dir + "/redirected", true},
+	}
+	for _, test := range tests {
+		os.Remove(filepath.Join(dir, "piped"))
+		os.Remove(filepath.Join(dir, "redirected"))
+		*allow = test.allow
+		output(func() { dispatch(L, test.line) })
+		_, pipedErr := os.Stat(filepath.Join(dir, "piped"))
+		_, redirectedErr := os.Stat(filepath.Join(dir, "redirected"))
+		created := pipedErr == nil || redirectedErr == nil
+		if created != test.created {
+			t.Errorf("--allow %s: %q created a file: %v, want %v", test.allow,
+				test.line, created, test.created)
+		}
+	}
+}
+
+func TestDispatchArgs(t *testing.T) {
+	// Arguments that have already been split up are passed on as they are
+	dir := t.TempDir()
+	L := newTestState(t, `
+		function do_echo(args) print(table.concat(args, ",")) end
+		function do_other() print("OTHER") end
+	`)
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"echo", "a;other"}, "a;other\n"},
+		{[]string{"echo", "a", "&&", "other"}, "a,&&,other\n"},
+		{[]string{"echo", ">", dir + "/out"}, ">," + dir + "/out\n"},
+		{[]string{"echo", "|", "cat"}, "|,cat\n"},
+		{[]string{"echo", "{a=1}"}, "{a=1}\n"},
+		{[]string{"echo", "# not a comment"}, "# not a comment\n"},
+		{[]string{"diffrun", "echo", "x;other"}, "No change\n"},
+	}
+	for _, test := range tests {
+		if got := output(func() { dispatchArgs(L, test.args) }); got != test.want {
+			t.Errorf("dispatchArgs(%q) printed %q, want %q", test.args, got,
+				test.want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out")); err == nil {
+		t.Error("dispatchArgs redirected output to a file")
+	}
+}